@@ -1,20 +1,62 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/xkmsoft/wikisearcher/pkg/apiserver"
+	"github.com/xkmsoft/wikisearcher/pkg/tcpclient"
 )
 
 func main() {
+	options := tcpclient.DefaultPoolOptions()
 	port := flag.Int("port", 3000, "port")
+	flag.IntVar(&options.MaxIdle, "max-idle", options.MaxIdle, "maximum number of idle engine connections")
+	flag.IntVar(&options.MaxOpen, "max-open", options.MaxOpen, "maximum number of open engine connections")
+	flag.DurationVar(&options.DialTimeout, "dial-timeout", options.DialTimeout, "timeout of dialing the engine")
+	flag.DurationVar(&options.ReadTimeout, "read-timeout", options.ReadTimeout, "timeout of the engine responses")
+	flag.IntVar(&options.Retries, "retries", options.Retries, "number of retries of the failed queries")
+	flag.DurationVar(&apiserver.QueryTimeout, "query-timeout", apiserver.QueryTimeout, "timeout of the queries, the partial results are returned after it")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "time to wait for the requests being handled when shutting down")
 	flag.Parse()
+	apiserver.Client = tcpclient.NewPool(apiserver.Ip, apiserver.Port, apiserver.Network, options)
 	router := mux.NewRouter()
 	router.HandleFunc("/api/query", apiserver.MakeGzipHandler(apiserver.HandleQuery)).Methods("POST")
-	fmt.Printf("API listening connection on :%d\n", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), router))
+	router.HandleFunc("/api/suggest", apiserver.MakeGzipHandler(apiserver.HandleSuggest)).Methods("POST")
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", *port),
+		Handler: router,
+	}
+	go func() {
+		fmt.Printf("API listening connection on :%d\n", *port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// The second signal terminates the process without waiting for the shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	signal.Stop(signals)
+	fmt.Printf("Received %s, shutting down the API server\n", received.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if e := apiserver.Client.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/xkmsoft/wikisearcher/pkg/engine"
 	"github.com/xkmsoft/wikisearcher/pkg/tcpserver"
 )
 
@@ -21,7 +29,18 @@ func main() {
 	port := flag.String("port", "3333", "port")
 	network := flag.String("network", "tcp", "Network should be [tcp, tcp4, tcp6]")
 	index := flag.Int("index", 1, "Abstract index [0, 27]")
+	indexes := flag.String("indexes", "", "Comma separated abstract indexes and ranges to search together, e.g. 1-27 (overrides index)")
 	clean := flag.Bool("clean", false, "Cleans all files within the data directory if set")
+	k1 := flag.Float64("k1", engine.DefaultK1, "BM25 term frequency saturation parameter")
+	b := flag.Float64("b", engine.DefaultB, "BM25 document length normalization parameter [0, 1]")
+	fuzziness := flag.Int("fuzziness", 0, "Edit distance tolerance [0, 2] applied to every query term")
+	preTag := flag.String("pre-tag", engine.DefaultPreTag, "Marker inserted before the highlighted words")
+	postTag := flag.String("post-tag", engine.DefaultPostTag, "Marker inserted after the highlighted words")
+	exportJSON := flag.Bool("export-json", false, "Exports the indexes into the JSON format next to the binary index dump if set")
+	mmap := flag.Bool("mmap", true, "Maps the binary index dump into the memory instead of loading it")
+	segments := flag.Bool("segments", true, "Persists the documents modified on the live index as segments within the data directory")
+	maxExpansions := flag.Int("max-expansions", engine.DefaultMaxExpansions, "Maximum number of terms a prefix or wildcard query is expanded to")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Time to wait for the requests being handled when shutting down")
 	flag.Parse()
 
 	allowedNetworks := map[string]string{"tcp": "", "tcp4": "", "tcp6": ""}
@@ -29,17 +48,58 @@ func main() {
 		log.Fatalf("Not allowed network %s. Network should be: %s\n", strings.ToLower(*network), GetAllowedNetworks(allowedNetworks))
 	}
 
-	if *index < 0 || *index > 27 {
+	fileIndexes := []int{*index}
+	if *indexes != "" {
+		var err error
+		if fileIndexes, err = tcpserver.ParseFileIndexes(*indexes); err != nil {
+			log.Fatalf("Wrong indexes: %s", err.Error())
+		}
+	} else if *index < 0 || *index > 27 {
 		log.Fatalf("Wrong index: %d Index should be [0, 27]", *index)
 	}
 
-	tcpServer := tcpserver.NewServer(*host, *port, *network, *index, *clean)
+	if *b < 0 || *b > 1 {
+		log.Fatalf("Wrong b: %f b should be [0, 1]", *b)
+	}
+
+	if *fuzziness < 0 || *fuzziness > engine.MaxFuzziness {
+		log.Fatalf("Wrong fuzziness: %d Fuzziness should be [0, %d]", *fuzziness, engine.MaxFuzziness)
+	}
+
+	if *maxExpansions < 1 {
+		log.Fatalf("Wrong max-expansions: %d It should be at least 1", *maxExpansions)
+	}
+
+	tcpServer := tcpserver.NewServer(*host, *port, *network, fileIndexes, *clean)
+	tcpServer.ExportJSON = *exportJSON
+	tcpServer.MemoryMap = *mmap
+	tcpServer.Segments = *segments
+	tcpServer.Indexer.Ranker = engine.NewBM25(*k1, *b)
+	tcpServer.Indexer.MaxExpansions = *maxExpansions
+	tcpServer.Indexer.Fuzziness = *fuzziness
+	tcpServer.Indexer.Highlighter = engine.NewHighlighter(*preTag, *postTag, engine.DefaultSnippetSize)
 
 	if err := tcpServer.InitializeServer(); err != nil {
 		log.Fatal(err)
 	}
 
-	if err := tcpServer.AcceptConnections(); err != nil {
+	tcpServer.HandleSignals()
+	go func() {
+		if err := tcpServer.AcceptConnections(); err != nil && !errors.Is(err, tcpserver.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// The second signal terminates the process without waiting for the shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	signal.Stop(signals)
+	fmt.Printf("Received %s\n", received.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := tcpServer.Shutdown(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
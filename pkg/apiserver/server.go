@@ -2,11 +2,14 @@ package apiserver
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/xkmsoft/wikisearcher/pkg/tcpclient"
 )
@@ -17,11 +20,24 @@ const (
 	Network = "tcp"
 )
 
+// Client is the connection pool shared by the handlers, the queries failing on a connection are retried.
+// It has to be set before the handlers are served.
+var Client tcpclient.PoolInterface
+
+// QueryTimeout bounds the queries and the completions of the handlers, the engine responds with the
+// partial results of a query exceeding it. The zero QueryTimeout only ends them along with the request.
+var QueryTimeout = 5 * time.Second
+
 type QueryParams struct {
 	Query string `json:"query"`
 	Page  int    `json:"page"`
 }
 
+type SuggestParams struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
 type gzipResponseWriter struct {
 	io.Writer
 	http.ResponseWriter
@@ -59,6 +75,28 @@ func MakeGzipHandler(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// ClientErrorStatus returns the status of the error responses of the engine as bad requests, of the
+// requests exceeding their deadlines as gateway timeout and of the failed connections as bad gateway
+func ClientErrorStatus(err error) int {
+	var responseError *tcpclient.ResponseError
+	if errors.As(err, &responseError) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// QueryContext returns the context of the request bounded by the QueryTimeout, so the engine stops
+// working on the request once the caller has gone away
+func QueryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if QueryTimeout > 0 {
+		return context.WithTimeout(r.Context(), QueryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
 func HandleQuery(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -68,12 +106,39 @@ func HandleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := tcpclient.NewTCPClient(Ip, Port, Network)
-	clientResponse, err := client.Query(params.Query, uint32(params.Page))
+	ctx, cancel := QueryContext(r)
+	defer cancel()
+	clientResponse, err := Client.QueryContext(ctx, params.Query, uint32(params.Page))
 	if err != nil {
+		http.Error(w, err.Error(), ClientErrorStatus(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(clientResponse); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+}
+
+func HandleSuggest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var params SuggestParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Limit < 0 {
+		http.Error(w, fmt.Sprintf("invalid limit: %d", params.Limit), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := QueryContext(r)
+	defer cancel()
+	clientResponse, err := Client.CompleteContext(ctx, params.Query, uint32(params.Limit))
+	if err != nil {
+		http.Error(w, err.Error(), ClientErrorStatus(err))
+		return
+	}
 	if err := json.NewEncoder(w).Encode(clientResponse); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
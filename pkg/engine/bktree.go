@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	MaxFuzziness = 2
+)
+
+type BKTreeInterface interface {
+	Add(word string)
+	Search(word string, distance int) []BKMatch
+	Len() int
+}
+
+type BKMatch struct {
+	Word     string
+	Distance int
+}
+
+type BKChild struct {
+	Distance int
+	Node     *BKNode
+}
+
+type BKNode struct {
+	Word     string
+	Children []BKChild
+}
+
+// BKTree is a Burkhard-Keller tree over the vocabulary. Since the Levenshtein distance is a metric,
+// only the children within [d - distance, d + distance] of a node at distance d have to be visited.
+type BKTree struct {
+	Root *BKNode
+	Size int
+}
+
+func NewBKTree(words []string) *BKTree {
+	tree := &BKTree{}
+	for _, word := range words {
+		tree.Add(word)
+	}
+	return tree
+}
+
+func (t *BKTree) Len() int {
+	return t.Size
+}
+
+func (t *BKTree) Add(word string) {
+	if t.Root == nil {
+		t.Root = &BKNode{Word: word}
+		t.Size++
+		return
+	}
+	node := t.Root
+	for {
+		distance := Levenshtein(word, node.Word)
+		if distance == 0 {
+			return
+		}
+		var next *BKNode
+		for _, child := range node.Children {
+			if child.Distance == distance {
+				next = child.Node
+				break
+			}
+		}
+		if next == nil {
+			node.Children = append(node.Children, BKChild{Distance: distance, Node: &BKNode{Word: word}})
+			t.Size++
+			return
+		}
+		node = next
+	}
+}
+
+// Search returns the words within the given Levenshtein distance of the word
+func (t *BKTree) Search(word string, distance int) []BKMatch {
+	matches := make([]BKMatch, 0)
+	if t.Root == nil {
+		return matches
+	}
+	stack := []*BKNode{t.Root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := Levenshtein(word, node.Word)
+		if d <= distance {
+			matches = append(matches, BKMatch{Word: node.Word, Distance: d})
+		}
+		for _, child := range node.Children {
+			if child.Distance >= d-distance && child.Distance <= d+distance {
+				stack = append(stack, child.Node)
+			}
+		}
+	}
+	return matches
+}
+
+// Levenshtein returns the number of single character insertions, deletions and substitutions
+// required to change a into b
+func Levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 {
+		return len(rb)
+	}
+	if len(rb) == 0 {
+		return len(ra)
+	}
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = MinInt(MinInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// BuildFuzzyTree builds the BK-tree of the vocabulary once the indexes are loaded, so the tree is not
+// built by the first fuzzy query or suggestion while it is searching
+func (i *Indexer) BuildFuzzyTree() {
+	t0 := time.Now()
+	i.SearchMutex.RLock()
+	defer i.SearchMutex.RUnlock()
+	tree := i.vocabularyTree()
+	i.DictionaryMutex.Lock()
+	i.BKTree = tree
+	i.PendingWords = nil
+	i.DictionaryMutex.Unlock()
+	fmt.Printf("Building the BK-tree of %d words took %f seconds\n", tree.Len(), time.Since(t0).Seconds())
+}
+
+func (i *Indexer) vocabularyTree() *BKTree {
+	words := make([]string, 0, len(i.Vocabulary))
+	for word := range i.Vocabulary {
+		words = append(words, word)
+	}
+	return NewBKTree(words)
+}
+
+// FuzzyTree returns the BK-tree of the vocabulary. The words added to the vocabulary after the tree is
+// built are inserted into the tree when it is requested next. The tree is built here only if the
+// indexer has not been loaded by BuildFuzzyTree.
+func (i *Indexer) FuzzyTree() *BKTree {
+	i.DictionaryMutex.Lock()
+	defer i.DictionaryMutex.Unlock()
+	if i.BKTree == nil {
+		i.BKTree = i.vocabularyTree()
+		i.PendingWords = nil
+		return i.BKTree
+	}
+	for _, word := range i.PendingWords {
+		i.BKTree.Add(word)
+	}
+	i.PendingWords = nil
+	return i.BKTree
+}
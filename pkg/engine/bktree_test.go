@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		distance int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"python", "pyhton", 2},
+		{"python", "pythons", 1},
+		{"flaw", "lawn", 2},
+		{"café", "cafe", 1},
+		{"naïve", "naïve", 0},
+	}
+	for _, test := range tests {
+		if distance := Levenshtein(test.a, test.b); distance != test.distance {
+			t.Errorf("%q %q: expected %d, got %d", test.a, test.b, test.distance, distance)
+		}
+	}
+}
+
+func TestBKTree(t *testing.T) {
+	tree := NewBKTree([]string{"book", "books", "cake", "boo", "cape", "cart", "boon", "book"})
+	if tree.Len() != 7 {
+		t.Fatalf("expected 7 distinct words, got %d", tree.Len())
+	}
+	tests := []struct {
+		word     string
+		distance int
+		expected []string
+	}{
+		{"book", 0, []string{"book"}},
+		{"book", 1, []string{"boo", "book", "books", "boon"}},
+		{"bok", 1, []string{"boo", "book"}},
+		{"cake", 1, []string{"cake", "cape"}},
+		{"care", 2, []string{"cake", "cape", "cart"}},
+		{"xyz", 2, []string{}},
+	}
+	for _, test := range tests {
+		words := make([]string, 0)
+		for _, match := range tree.Search(test.word, test.distance) {
+			if match.Distance != Levenshtein(test.word, match.Word) {
+				t.Errorf("%s: unexpected distance %d of %s", test.word, match.Distance, match.Word)
+			}
+			words = append(words, match.Word)
+		}
+		sort.Strings(words)
+		if !reflect.DeepEqual(words, test.expected) {
+			t.Errorf("%s within %d: expected %v, got %v", test.word, test.distance, test.expected, words)
+		}
+	}
+	if matches := NewBKTree(nil).Search("book", 2); len(matches) != 0 {
+		t.Errorf("expected no matches in an empty tree, got %v", matches)
+	}
+}
+
+func TestParseFuzzy(t *testing.T) {
+	tests := []struct {
+		text     string
+		word     string
+		distance int
+		fuzzy    bool
+	}{
+		{"python~", "python", MaxFuzziness, true},
+		{"python~1", "python", 1, true},
+		{"python~5", "python", MaxFuzziness, true},
+		{"python~x", "python~x", 0, false},
+		{"python~-1", "python~-1", 0, false},
+		{"~1", "~1", 0, false},
+		{"python", "python", 0, false},
+	}
+	for _, test := range tests {
+		word, distance, fuzzy := ParseFuzzy(test.text)
+		if word != test.word || distance != test.distance || fuzzy != test.fuzzy {
+			t.Errorf("%s: expected %s %d %v, got %s %d %v", test.text, test.word, test.distance, test.fuzzy, word, distance, fuzzy)
+		}
+	}
+}
+
+func TestFuzzyQueries(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"pyhton~", []string{"Python", "Python (snake)"}},
+		{"pyhton~1", []string{}},
+		{"rubi~1", []string{"Ruby"}},
+		{"title:kobra~1", []string{"Cobra"}},
+		{"snaek~ -venomous", []string{"Python (snake)"}},
+	}
+	for _, test := range tests {
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+
+	// The exact matches outrank the fuzzy ones
+	if titles := SearchTitles(t, indexer, "perl~1"); len(titles) != 2 || titles[0] != "Perl" {
+		t.Errorf("expected the exact match first, got %v", titles)
+	}
+	// The Fuzziness applies to every word
+	indexer.Fuzziness = 1
+	if titles := MatchedTitles(t, indexer, "rubi"); !reflect.DeepEqual(titles, []string{"Ruby"}) {
+		t.Errorf("expected the fuzzy match, got %v", titles)
+	}
+}
+
+func TestBuildFuzzyTree(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	indexer.BuildFuzzyTree()
+	tree := indexer.BKTree
+	if tree == nil || tree.Len() != len(indexer.Vocabulary) {
+		t.Fatalf("expected a tree of %d words", len(indexer.Vocabulary))
+	}
+	if _, err := indexer.AddDocument(WikiXMLDoc{Title: "Quokka", Url: "https://en.wikipedia.org/wiki/Quokka"}); err != nil {
+		t.Fatal(err)
+	}
+	// The searches insert the new words into the built tree instead of building it again
+	if indexer.FuzzyTree() != tree || tree.Len() != len(indexer.Vocabulary) {
+		t.Fatalf("expected the new words to be inserted into the built tree")
+	}
+}
@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultCompletionLimit = 10
+	MaxCompletionLimit     = 100
+	TitlePrefix            = "Wikipedia: "
+)
+
+type Completion struct {
+	Title  string  `json:"title"`
+	Url    string  `json:"url"`
+	Weight float64 `json:"weight"`
+}
+
+type CompletionResults struct {
+	Processed   Processed    `json:"processed"`
+	Prefix      string       `json:"prefix"`
+	Completions []Completion `json:"completions"`
+}
+
+type CompletionEntry struct {
+	Index  uint32
+	Weight float64
+}
+
+// CompletionNode is a node of the radix tree. Weight is the highest weight of the entries within the
+// subtree of the node, which allows visiting the subtrees in the best-first order.
+type CompletionNode struct {
+	Label    string
+	Children []*CompletionNode
+	Entries  []CompletionEntry
+	Weight   float64
+}
+
+type CompleterInterface interface {
+	Add(doc WikiXMLDoc)
+	Remove(doc WikiXMLDoc)
+	Complete(prefix string, limit int) []CompletionEntry
+}
+
+// Completer is a radix tree over the normalized article titles used for the search-as-you-type completions
+type Completer struct {
+	Root *CompletionNode
+	Size int
+}
+
+func NewCompleter() *Completer {
+	return &Completer{
+		Root: &CompletionNode{},
+	}
+}
+
+// NormalizeTitle lowercases the title and removes the common Wikipedia prefix of the titles
+func NormalizeTitle(title string) string {
+	return strings.ToLower(strings.TrimLeft(strings.TrimPrefix(title, TitlePrefix), " "))
+}
+
+// CompletionWeight is a popularity heuristic for the titles. The articles with longer abstracts tend
+// to be the well known ones, and the shorter titles are preferred over the longer (e.g. disambiguated) ones.
+func CompletionWeight(doc WikiXMLDoc) float64 {
+	words := len(strings.Fields(strings.TrimPrefix(doc.Title, TitlePrefix)))
+	return math.Log1p(float64(len(doc.Abstract))) / float64(1+words)
+}
+
+func CommonPrefixLength(a string, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func (c *Completer) Add(doc WikiXMLDoc) {
+	key := NormalizeTitle(doc.Title)
+	if key == "" {
+		return
+	}
+	entry := CompletionEntry{Index: doc.Index, Weight: CompletionWeight(doc)}
+	c.Size++
+
+	node := c.Root
+	for {
+		node.Weight = math.Max(node.Weight, entry.Weight)
+		if key == "" {
+			node.Entries = append(node.Entries, entry)
+			return
+		}
+		var child *CompletionNode
+		for _, candidate := range node.Children {
+			if candidate.Label[0] == key[0] {
+				child = candidate
+				break
+			}
+		}
+		if child == nil {
+			node.Children = append(node.Children, &CompletionNode{
+				Label:   key,
+				Entries: []CompletionEntry{entry},
+				Weight:  entry.Weight,
+			})
+			return
+		}
+		common := CommonPrefixLength(child.Label, key)
+		if common < len(child.Label) {
+			// Splitting the child so the common part of the labels becomes the parent of both
+			split := &CompletionNode{
+				Label:    child.Label[common:],
+				Children: child.Children,
+				Entries:  child.Entries,
+				Weight:   child.Weight,
+			}
+			child.Label = child.Label[:common]
+			child.Children = []*CompletionNode{split}
+			child.Entries = nil
+		}
+		key = key[common:]
+		node = child
+	}
+}
+
+// Remove removes the entry of the document from the node of its title. The weights of the ancestor
+// nodes are left as they are, since they are only upper bounds for the best-first search.
+func (c *Completer) Remove(doc WikiXMLDoc) {
+	key := NormalizeTitle(doc.Title)
+	if key == "" {
+		return
+	}
+	node := c.Root
+	for key != "" {
+		var next *CompletionNode
+		for _, child := range node.Children {
+			if strings.HasPrefix(key, child.Label) {
+				next = child
+				key = key[len(child.Label):]
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		node = next
+	}
+	for idx, entry := range node.Entries {
+		if entry.Index == doc.Index {
+			node.Entries = append(node.Entries[:idx], node.Entries[idx+1:]...)
+			c.Size--
+			return
+		}
+	}
+}
+
+// Complete returns at most limit entries whose normalized titles start with the prefix, in the
+// descending order of their weights
+func (c *Completer) Complete(prefix string, limit int) []CompletionEntry {
+	entries := make([]CompletionEntry, 0, limit)
+	key := NormalizeTitle(prefix)
+	if key == "" {
+		return entries
+	}
+	node := c.Root
+	for key != "" {
+		var next *CompletionNode
+		for _, child := range node.Children {
+			common := CommonPrefixLength(child.Label, key)
+			if common == len(key) || common == len(child.Label) {
+				next = child
+				key = key[common:]
+				break
+			}
+		}
+		if next == nil {
+			return entries
+		}
+		node = next
+	}
+
+	queue := &completionQueue{}
+	heap.Push(queue, completionItem{node: node, weight: node.Weight})
+	for queue.Len() > 0 && len(entries) < limit {
+		item := heap.Pop(queue).(completionItem)
+		if item.node == nil {
+			entries = append(entries, item.entry)
+			continue
+		}
+		for _, entry := range item.node.Entries {
+			heap.Push(queue, completionItem{entry: entry, weight: entry.Weight})
+		}
+		for _, child := range item.node.Children {
+			heap.Push(queue, completionItem{node: child, weight: child.Weight})
+		}
+	}
+	return entries
+}
+
+// completionItem is either a subtree or an entry waiting in the best-first queue
+type completionItem struct {
+	node   *CompletionNode
+	entry  CompletionEntry
+	weight float64
+}
+
+type completionQueue []completionItem
+
+func (q completionQueue) Len() int            { return len(q) }
+func (q completionQueue) Less(a, b int) bool  { return q[a].weight > q[b].weight }
+func (q completionQueue) Swap(a, b int)       { q[a], q[b] = q[b], q[a] }
+func (q *completionQueue) Push(x interface{}) { *q = append(*q, x.(completionItem)) }
+func (q *completionQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// BuildCompletions rebuilds the completion index from the loaded documents
+func (i *Indexer) BuildCompletions() {
+	t0 := time.Now()
+	completer := NewCompleter()
+	i.SearchMutex.RLock()
+	for _, doc := range i.Data {
+		completer.Add(doc)
+	}
+	i.SearchMutex.RUnlock()
+
+	i.SearchMutex.Lock()
+	i.Completer = completer
+	i.SearchMutex.Unlock()
+	fmt.Printf("Building completions of %d titles took %f seconds\n", completer.Size, time.Since(t0).Seconds())
+}
+
+func (i *Indexer) Complete(prefix string, limit int) CompletionResults {
+	t0 := time.Now()
+	i.SearchMutex.RLock()
+	defer i.SearchMutex.RUnlock()
+	if limit <= 0 {
+		limit = DefaultCompletionLimit
+	}
+	limit = MinInt(limit, MaxCompletionLimit)
+
+	completions := make([]Completion, 0, limit)
+	for _, entry := range i.Completer.Complete(prefix, limit) {
+		if doc, ok := i.Data[entry.Index]; ok {
+			completions = append(completions, Completion{
+				Title:  doc.Title,
+				Url:    doc.Url,
+				Weight: entry.Weight,
+			})
+		}
+	}
+	return CompletionResults{
+		Processed:   ElapsedSince(t0),
+		Prefix:      prefix,
+		Completions: completions,
+	}
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func CompletedTitles(indexer *Indexer, prefix string, limit int) []string {
+	titles := make([]string, 0)
+	for _, completion := range indexer.Complete(prefix, limit).Completions {
+		titles = append(titles, completion.Title)
+	}
+	return titles
+}
+
+func TestComplete(t *testing.T) {
+	// The weights are decreasing with the number of words of the titles and increasing with the
+	// lengths of the abstracts
+	indexer := NewTestIndexer(t, []WikiXMLDoc{
+		{Title: "Python (programming language)", Abstract: strings.Repeat("python ", 150)},
+		{Title: "Wikipedia: Pyramid", Abstract: "a pyramid"},
+		{Title: "Pythagoras", Abstract: strings.Repeat("greek ", 20)},
+		{Title: "Python", Abstract: strings.Repeat("snake ", 200)},
+		{Title: "Perl", Abstract: strings.Repeat("perl ", 20)},
+	})
+	tests := []struct {
+		prefix string
+		limit  int
+		titles []string
+	}{
+		{"py", 10, []string{"Python", "Pythagoras", "Python (programming language)", "Wikipedia: Pyramid"}},
+		{"PYTHON", 10, []string{"Python", "Python (programming language)"}},
+		{"pyth", 2, []string{"Python", "Pythagoras"}},
+		{"python (", 10, []string{"Python (programming language)"}},
+		{"Wikipedia: pyr", 10, []string{"Wikipedia: Pyramid"}},
+		{"p", 0, []string{"Python", "Pythagoras", "Perl", "Python (programming language)", "Wikipedia: Pyramid"}},
+		{"pythons", 10, []string{}},
+		{"ruby", 10, []string{}},
+		{"", 10, []string{}},
+	}
+	for _, test := range tests {
+		if titles := CompletedTitles(indexer, test.prefix, test.limit); !reflect.DeepEqual(titles, test.titles) {
+			t.Errorf("%s: expected %v, got %v", test.prefix, test.titles, titles)
+		}
+	}
+}
+
+func TestCompleteModifiedDocuments(t *testing.T) {
+	indexer := NewTestIndexer(t, []WikiXMLDoc{
+		{Title: "Python", Abstract: "a snake"},
+		{Title: "Pythagoras", Abstract: "a greek philosopher"},
+	})
+	if _, err := indexer.DeleteDocument("https://en.wikipedia.org/wiki/Pythagoras"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexer.UpdateDocument(WikiXMLDoc{Title: "Monty Python", Url: "https://en.wikipedia.org/wiki/Python", Abstract: "a comedy group"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		titles []string
+	}{
+		{"pyth", []string{}},
+		{"monty", []string{"Monty Python"}},
+	}
+	for _, test := range tests {
+		if titles := CompletedTitles(indexer, test.prefix, 10); !reflect.DeepEqual(titles, test.titles) {
+			t.Errorf("%s: expected %v, got %v", test.prefix, test.titles, titles)
+		}
+	}
+}
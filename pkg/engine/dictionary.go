@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	DefaultMaxExpansions = 128
+	WildcardCharacters   = "*?"
+)
+
+type DictionaryInterface interface {
+	Prefix(prefix string, max int) []string
+	Match(pattern string, max int) []string
+	Len() int
+}
+
+// Dictionary is the sorted list of the terms of an index. It enumerates the terms by prefix with a
+// binary search, so the wildcard patterns are only matched within the range of their literal prefix.
+// Generation is the Generation of the indexer the dictionary was built from.
+type Dictionary struct {
+	Terms      []string
+	Generation uint64
+}
+
+func NewDictionary(terms []string) *Dictionary {
+	sort.Strings(terms)
+	return &Dictionary{
+		Terms: terms,
+	}
+}
+
+func (d *Dictionary) Len() int {
+	return len(d.Terms)
+}
+
+// Prefix returns at most max terms starting with the prefix in the lexicographical order
+func (d *Dictionary) Prefix(prefix string, max int) []string {
+	terms := make([]string, 0)
+	for idx := sort.SearchStrings(d.Terms, prefix); idx < len(d.Terms) && len(terms) < max; idx++ {
+		if !strings.HasPrefix(d.Terms[idx], prefix) {
+			break
+		}
+		terms = append(terms, d.Terms[idx])
+	}
+	return terms
+}
+
+// Match returns at most max terms matching the glob pattern, where * matches any sequence of
+// characters and ? matches a single character
+func (d *Dictionary) Match(pattern string, max int) []string {
+	terms := make([]string, 0)
+	literal := pattern
+	if idx := strings.IndexAny(pattern, WildcardCharacters); idx >= 0 {
+		literal = pattern[:idx]
+	}
+	for idx := sort.SearchStrings(d.Terms, literal); idx < len(d.Terms) && len(terms) < max; idx++ {
+		term := d.Terms[idx]
+		if !strings.HasPrefix(term, literal) {
+			break
+		}
+		if matched, err := path.Match(pattern, term); err != nil {
+			return terms
+		} else if matched {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func IsWildcard(s string) bool {
+	return strings.ContainsAny(s, WildcardCharacters)
+}
+
+// TermDictionary returns the dictionary of the field, the dictionary of the DefaultFields is returned
+// for an empty field. The dictionary is rebuilt lazily when the Generation of the indexer has advanced.
+func (i *Indexer) TermDictionary(field string) *Dictionary {
+	generation := atomic.LoadUint64(&i.Generation)
+	i.DictionaryMutex.Lock()
+	defer i.DictionaryMutex.Unlock()
+	if dictionary, exists := i.Dictionaries[field]; exists && dictionary.Generation == generation {
+		return dictionary
+	}
+	fields := i.SearchFields(field)
+	size := 0
+	for _, fieldIndex := range fields {
+		size += fieldIndex.Len()
+	}
+	unique := make(map[string]bool, size)
+	terms := make([]string, 0, size)
+	for _, fieldIndex := range fields {
+		for _, term := range fieldIndex.Terms() {
+			if !unique[term] {
+				unique[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	dictionary := NewDictionary(terms)
+	dictionary.Generation = generation
+	i.Dictionaries[field] = dictionary
+	return dictionary
+}
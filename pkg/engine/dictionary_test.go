@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDictionary(t *testing.T) {
+	dictionary := NewDictionary([]string{"python", "perl", "pascal", "php", "prolog", "ruby", "rust", "pyt"})
+	tests := []struct {
+		name     string
+		terms    []string
+		expected []string
+	}{
+		{"prefix", dictionary.Prefix("p", 10), []string{"pascal", "perl", "php", "prolog", "pyt", "python"}},
+		{"limited prefix", dictionary.Prefix("p", 2), []string{"pascal", "perl"}},
+		{"whole term prefix", dictionary.Prefix("pyt", 10), []string{"pyt", "python"}},
+		{"missing prefix", dictionary.Prefix("q", 10), []string{}},
+		{"prefix after the last term", dictionary.Prefix("z", 10), []string{}},
+		{"suffix wildcard", dictionary.Match("r*", 10), []string{"ruby", "rust"}},
+		{"single character", dictionary.Match("p?p", 10), []string{"php"}},
+		{"inner wildcard", dictionary.Match("p*l", 10), []string{"pascal", "perl"}},
+		{"leading wildcard", dictionary.Match("*l", 10), []string{"pascal", "perl"}},
+		{"limited pattern", dictionary.Match("*", 3), []string{"pascal", "perl", "php"}},
+		{"literal pattern", dictionary.Match("rust", 10), []string{"rust"}},
+		{"invalid pattern", dictionary.Match("r[", 10), []string{}},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.terms, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.terms)
+		}
+	}
+	if dictionary.Len() != 8 {
+		t.Errorf("expected 8 terms, got %d", dictionary.Len())
+	}
+}
+
+func TestWildcardQueries(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"pyth*", []string{"Python", "Python (snake)"}},
+		{"PYTH*", []string{"Python", "Python (snake)"}},
+		{"program*", []string{"Python", "Ruby"}},
+		{"sna?e", []string{"Cobra", "Python (snake)"}},
+		{"title:p*", []string{"Perl", "Python", "Python (snake)"}},
+		{"url:*snake*", []string{"Python (snake)"}},
+		{"p*rl -title:perl", []string{"Ruby"}},
+		{"zz*", []string{}},
+	}
+	for _, test := range tests {
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+
+	// The expansions are limited to the MaxExpansions terms in the lexicographical order
+	indexer.MaxExpansions = 1
+	if titles := MatchedTitles(t, indexer, "p*"); !reflect.DeepEqual(titles, []string{"Perl", "Ruby"}) {
+		t.Errorf("expected the first expansion only, got %v", titles)
+	}
+}
+
+func TestDictionaryGeneration(t *testing.T) {
+	indexer := NewTestIndexer(t, []WikiXMLDoc{{Title: "Zebra", Abstract: "zebra animal", Url: "https://en.wikipedia.org/wiki/Zebra_animal"}})
+	// The cached dictionaries are only rebuilt when a term is added or finally removed
+	tests := []struct {
+		name     string
+		modify   func() error
+		advanced bool
+	}{
+		{"known terms", func() error {
+			_, err := indexer.AddDocument(WikiXMLDoc{Title: "Zebra", Abstract: "animal", Url: "https://en.wikipedia.org/wiki/Animal_zebra"})
+			return err
+		}, false},
+		{"new terms", func() error {
+			_, err := indexer.AddDocument(WikiXMLDoc{Title: "Okapi", Url: "https://en.wikipedia.org/wiki/Okapi"})
+			return err
+		}, true},
+		{"shared terms", func() error {
+			_, err := indexer.DeleteDocument("https://en.wikipedia.org/wiki/Animal_zebra")
+			return err
+		}, false},
+		{"last terms", func() error {
+			_, err := indexer.DeleteDocument("https://en.wikipedia.org/wiki/Okapi")
+			return err
+		}, true},
+	}
+	for _, test := range tests {
+		dictionary := indexer.TermDictionary("")
+		if err := test.modify(); err != nil {
+			t.Fatal(err)
+		}
+		if advanced := indexer.TermDictionary("") != dictionary; advanced != test.advanced {
+			t.Errorf("%s: expected the dictionary to be rebuilt %t, got %t", test.name, test.advanced, advanced)
+		}
+	}
+	if terms := indexer.TermDictionary("").Prefix("", 10); !reflect.DeepEqual(terms, []string{"anim", "zebra"}) {
+		t.Errorf("unexpected terms %v", terms)
+	}
+}
@@ -0,0 +1,295 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+var (
+	ErrDocumentExists   = errors.New("document already exists")
+	ErrDocumentNotFound = errors.New("document not found")
+)
+
+// DocumentResult is the response of the document modifications, Index is the index of the added,
+// updated or deleted document
+type DocumentResult struct {
+	Processed Processed `json:"processed"`
+	Index     uint32    `json:"index"`
+	Url       string    `json:"url"`
+}
+
+type DocumentsInterface interface {
+	AddDocument(doc WikiXMLDoc) (DocumentResult, error)
+	UpdateDocument(doc WikiXMLDoc) (DocumentResult, error)
+	DeleteDocument(url string) (DocumentResult, error)
+	RemoveIndex(field string, tokens []Token, index uint32)
+	EvictIndex(field string, tokens []Token, index uint32)
+	DocumentIndex(url string) (uint32, bool)
+	ReplayLog(records []LogRecord)
+}
+
+// AddDocument indexes a new document under a new index, the Index of the given document is ignored.
+// The documents are identified by their urls, so the url must not be used by another document.
+func (i *Indexer) AddDocument(doc WikiXMLDoc) (DocumentResult, error) {
+	t0 := time.Now()
+	if strings.TrimSpace(doc.Url) == "" {
+		return DocumentResult{}, fmt.Errorf("document has no url")
+	}
+	doc, err := i.modifyDocument(LogAdd, doc)
+	if err != nil {
+		return DocumentResult{}, err
+	}
+	return DocumentResult{Processed: ElapsedSince(t0), Index: doc.Index, Url: doc.Url}, nil
+}
+
+// UpdateDocument replaces the document having the same url. The old version is deleted and the new
+// version gets a new index, since the postings of the old version might be kept by immutable dumps.
+func (i *Indexer) UpdateDocument(doc WikiXMLDoc) (DocumentResult, error) {
+	t0 := time.Now()
+	doc, err := i.modifyDocument(LogUpdate, doc)
+	if err != nil {
+		return DocumentResult{}, err
+	}
+	return DocumentResult{Processed: ElapsedSince(t0), Index: doc.Index, Url: doc.Url}, nil
+}
+
+// DeleteDocument removes the in-memory postings of the document and marks its index as deleted, so
+// the postings kept by the mapped dumps are never matched
+func (i *Indexer) DeleteDocument(url string) (DocumentResult, error) {
+	t0 := time.Now()
+	doc, err := i.modifyDocument(LogDelete, WikiXMLDoc{Url: url})
+	if err != nil {
+		return DocumentResult{}, err
+	}
+	return DocumentResult{Processed: ElapsedSince(t0), Index: doc.Index, Url: doc.Url}, nil
+}
+
+// modifyDocument checks the modification and assigns the index of the document holding the
+// SearchMutex for writing, the index of a deleted document is its current index. The record of the
+// modification is appended to the log without the SearchMutex, so syncing the log does not block the
+// searches, and the modification is applied holding the SearchMutex for writing again. The LogMutex
+// serializes the modifications, so they are applied in the order of their records.
+func (i *Indexer) modifyDocument(operation byte, doc WikiXMLDoc) (WikiXMLDoc, error) {
+	i.LogMutex.Lock()
+	defer i.LogMutex.Unlock()
+
+	i.SearchMutex.Lock()
+	previous, exists := i.DocumentIndex(doc.Url)
+	if operation == LogAdd && exists {
+		i.SearchMutex.Unlock()
+		return doc, fmt.Errorf("%s: %w", doc.Url, ErrDocumentExists)
+	}
+	if operation != LogAdd && !exists {
+		i.SearchMutex.Unlock()
+		return doc, fmt.Errorf("%s: %w", doc.Url, ErrDocumentNotFound)
+	}
+	if operation == LogDelete {
+		doc.Index = previous
+	} else {
+		doc.Index = i.newIndex()
+	}
+	i.SearchMutex.Unlock()
+
+	if err := i.logDocument(operation, doc); err != nil {
+		return doc, err
+	}
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	i.applyDocument(operation, doc, previous)
+	return doc, nil
+}
+
+// applyDocument deletes the previous version of the updated and the deleted documents, and adds the
+// added and the updated documents under their indexes
+func (i *Indexer) applyDocument(operation byte, doc WikiXMLDoc, previous uint32) {
+	if operation != LogAdd {
+		i.deleteDocument(previous)
+	}
+	if operation != LogDelete {
+		i.addDocument(doc)
+	}
+}
+
+// DocumentIndex returns the index of the document having the url, the url lookup is rebuilt lazily
+// when the number of the documents has changed
+func (i *Indexer) DocumentIndex(url string) (uint32, bool) {
+	if i.Urls == nil || len(i.Urls) != len(i.Data) {
+		i.Urls = make(map[string]uint32, len(i.Data))
+		for index, doc := range i.Data {
+			i.Urls[doc.Url] = index
+		}
+	}
+	index, exists := i.Urls[url]
+	return index, exists
+}
+
+// newIndex returns the index of a new document. The new documents are numbered after the loaded and
+// the deleted ones, and the indexes of the deleted documents are never reused.
+func (i *Indexer) newIndex() uint32 {
+	if i.NextIndex == 0 {
+		if documents := i.AllDocuments(); !documents.IsEmpty() {
+			i.NextIndex = documents.Maximum() + 1
+		}
+		if !i.Deleted.IsEmpty() && i.Deleted.Maximum() >= i.NextIndex {
+			i.NextIndex = i.Deleted.Maximum() + 1
+		}
+	}
+	index := i.NextIndex
+	i.NextIndex++
+	return index
+}
+
+// ReplayLog applies the modifications recorded by the write-ahead log under their recorded indexes.
+// The records of the modifications persisted by the segments before a crash, e.g. between writing the
+// manifest and checkpointing the log, are skipped since their indexes are known to the indexer
+// already. The indexes are assigned in the order of the records, so the records after the first
+// unknown index have not been persisted either.
+func (i *Indexer) ReplayLog(records []LogRecord) {
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	for _, record := range records {
+		doc := record.Document
+		previous, exists := i.DocumentIndex(doc.Url)
+		_, known := i.Data[doc.Index]
+		known = known || i.Deleted.Contains(doc.Index)
+		var err error
+		switch {
+		case record.Operation > LogDelete:
+			err = fmt.Errorf("unknown operation %d", record.Operation)
+		case record.Operation == LogDelete && !exists:
+			err = ErrDocumentNotFound
+		case record.Operation == LogDelete && previous != doc.Index:
+			err = fmt.Errorf("document %d was deleted already", doc.Index)
+		case record.Operation != LogDelete && known:
+			err = fmt.Errorf("document %d was persisted already", doc.Index)
+		case record.Operation == LogAdd && exists:
+			err = ErrDocumentExists
+		case record.Operation == LogUpdate && !exists:
+			err = ErrDocumentNotFound
+		}
+		if err != nil {
+			fmt.Printf("Skipping the write-ahead log record of %s: %s\n", doc.Url, err.Error())
+			continue
+		}
+		if record.Operation != LogDelete {
+			// The following modifications continue after the recorded index
+			i.newIndex()
+			if i.NextIndex <= doc.Index {
+				i.NextIndex = doc.Index + 1
+			}
+		}
+		i.applyDocument(record.Operation, doc, previous)
+	}
+}
+
+func (i *Indexer) logDocument(operation byte, doc WikiXMLDoc) error {
+	if i.Log == nil {
+		return nil
+	}
+	return i.Log.Append(operation, doc)
+}
+
+func (i *Indexer) addDocument(doc WikiXMLDoc) {
+	i.AddIndex(TitleField, i.AnalyzeTokens(doc.Title), doc.Index)
+	i.AddIndex(AbstractField, i.AnalyzeTokens(doc.Abstract), doc.Index)
+	i.AddIndex(UrlField, i.AnalyzeTokens(UrlPath(doc.Url)), doc.Index)
+	i.Data[doc.Index] = doc
+	i.Documents.Add(doc.Index)
+	i.Urls[doc.Url] = doc.Index
+	i.Buffered.Add(doc.Index)
+	i.Completer.Add(doc)
+}
+
+func (i *Indexer) deleteDocument(index uint32) {
+	doc := i.Data[index]
+	i.RemoveIndex(TitleField, i.AnalyzeTokens(doc.Title), index)
+	i.RemoveIndex(AbstractField, i.AnalyzeTokens(doc.Abstract), index)
+	i.RemoveIndex(UrlField, i.AnalyzeTokens(UrlPath(doc.Url)), index)
+	i.Completer.Remove(doc)
+	delete(i.Data, index)
+	i.Documents.Remove(index)
+	delete(i.Urls, doc.Url)
+	i.Buffered.Remove(index)
+	i.Deleted.Add(index)
+}
+
+func (i *Indexer) evictDocument(doc WikiXMLDoc) {
+	i.EvictIndex(TitleField, i.AnalyzeTokens(doc.Title), doc.Index)
+	i.EvictIndex(AbstractField, i.AnalyzeTokens(doc.Abstract), doc.Index)
+	i.EvictIndex(UrlField, i.AnalyzeTokens(UrlPath(doc.Url)), doc.Index)
+}
+
+// RemoveIndex removes the document from the in-memory postings of the tokens within the field. Like
+// AddIndex, the SearchMutex has to be held for writing if the indexer is being searched.
+func (i *Indexer) RemoveIndex(field string, tokens []Token, index uint32) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+	i.Fields[field].RemoveLength(index)
+	i.removePostings(field, tokens, index)
+}
+
+// EvictIndex removes the flushed document from the in-memory postings of the field, its postings and
+// its length are served by its segment afterwards
+func (i *Indexer) EvictIndex(field string, tokens []Token, index uint32) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+	delete(i.Fields[field].Lengths, index)
+	i.removePostings(field, tokens, index)
+}
+
+func (i *Indexer) removePostings(field string, tokens []Token, index uint32) {
+	fieldIndex := i.Fields[field]
+	isDefault := IsDefaultField(field)
+	terms := make(map[string]bool, len(tokens))
+	for idx := range tokens {
+		terms[tokens[idx].Term] = true
+	}
+	for term := range terms {
+		indexes, exists := fieldIndex.Indexes[term]
+		if !exists {
+			continue
+		}
+		indexes.Remove(index)
+		delete(fieldIndex.Positions[term], index)
+		if indexes.IsEmpty() {
+			delete(fieldIndex.Indexes, term)
+			delete(fieldIndex.Positions, term)
+			if !fieldIndex.IsMapped(term) {
+				i.Modified()
+			}
+		}
+		if isDefault {
+			i.removeDefaultIndex(term, index)
+		}
+	}
+}
+
+// removeDefaultIndex removes the document from the union of the DefaultFields in-memory postings of
+// the term unless another default field still contains the term
+func (i *Indexer) removeDefaultIndex(term string, index uint32) {
+	for _, field := range i.SearchFields("") {
+		if indexes, exists := field.Indexes[term]; exists && indexes.Contains(index) {
+			return
+		}
+	}
+	indexes, exists := i.Indexes[term]
+	if !exists {
+		return
+	}
+	indexes.Remove(index)
+	if indexes.IsEmpty() {
+		delete(i.Indexes, term)
+	}
+}
+
+// Live returns the documents of the bitmap which are not deleted
+func (i *Indexer) Live(rb *roaring.Bitmap) *roaring.Bitmap {
+	if i.Deleted.IsEmpty() {
+		return rb
+	}
+	return roaring.AndNot(rb, i.Deleted)
+}
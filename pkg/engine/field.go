@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+const (
+	TitleField     = "title"
+	AbstractField  = "abstract"
+	UrlField       = "url"
+	WikiPathPrefix = "/wiki/"
+)
+
+// Fields are the indexed fields of a document, the queries without a field scope are searched
+// within the DefaultFields
+var (
+	Fields        = []string{TitleField, AbstractField, UrlField}
+	DefaultFields = []string{TitleField, AbstractField}
+	DefaultBoosts = map[string]float64{
+		TitleField:    2.0,
+		AbstractField: 1.0,
+		UrlField:      1.0,
+	}
+)
+
+// FieldIndex keeps the postings of a single document field. Boost is the weight of the field
+// while ranking, so the title hits can outrank the abstract-only hits. The postings of a term are
+// the union of the in-memory Indexes and the postings of the immutable memory mapped dumps, whose
+// documents are never modified but masked by the deleted documents of the indexer instead.
+type FieldIndex struct {
+	Name        string
+	Boost       float64
+	Indexes     map[string]*roaring.Bitmap
+	Positions   map[string]map[uint32][]uint32
+	Lengths     map[uint32]uint32
+	TotalLength uint64
+	Mapped      []*MappedField
+}
+
+func NewFieldIndex(name string, boost float64) *FieldIndex {
+	return &FieldIndex{
+		Name:        name,
+		Boost:       boost,
+		Indexes:     map[string]*roaring.Bitmap{},
+		Positions:   map[string]map[uint32][]uint32{},
+		Lengths:     map[uint32]uint32{},
+		TotalLength: 0,
+	}
+}
+
+func NewFieldIndexes() map[string]*FieldIndex {
+	fields := make(map[string]*FieldIndex, len(Fields))
+	for _, name := range Fields {
+		fields[name] = NewFieldIndex(name, DefaultBoosts[name])
+	}
+	return fields
+}
+
+func IsField(name string) bool {
+	for _, field := range Fields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+func IsDefaultField(name string) bool {
+	for _, field := range DefaultFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// UrlPath returns the searchable part of the document url, e.g. Anarchism for https://en.wikipedia.org/wiki/Anarchism
+func UrlPath(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(parsed.Path, WikiPathPrefix)
+}
+
+// Map makes the field serve the postings of the mapped field
+func (f *FieldIndex) Map(mapped *MappedField) {
+	f.Mapped = append(f.Mapped, mapped)
+	for _, length := range mapped.Lengths {
+		f.TotalLength += uint64(length)
+	}
+}
+
+// RemoveLength removes the length of the document from the field. The length of a mapped document is
+// hidden by a zero length instead, since the mapped dumps are immutable.
+func (f *FieldIndex) RemoveLength(index uint32) {
+	f.TotalLength -= uint64(f.Length(index))
+	if len(f.Mapped) > 0 {
+		f.Lengths[index] = 0
+	} else {
+		delete(f.Lengths, index)
+	}
+}
+
+// Bitmap returns the documents containing the term or nil if the term does not exist in the field
+func (f *FieldIndex) Bitmap(term string) *roaring.Bitmap {
+	indexes, exists := f.Indexes[term]
+	if len(f.Mapped) == 0 {
+		return indexes
+	}
+	bitmaps := make([]*roaring.Bitmap, 0, len(f.Mapped)+1)
+	if exists {
+		bitmaps = append(bitmaps, indexes)
+	}
+	for _, mapped := range f.Mapped {
+		if bitmap := mapped.Bitmap(term); bitmap != nil {
+			bitmaps = append(bitmaps, bitmap)
+		}
+	}
+	switch len(bitmaps) {
+	case 0:
+		return nil
+	case 1:
+		return bitmaps[0]
+	default:
+		return roaring.FastOr(bitmaps...)
+	}
+}
+
+func (f *FieldIndex) TermPositions(term string, index uint32) []uint32 {
+	if positions, exists := f.Positions[term][index]; exists || len(f.Mapped) == 0 {
+		return positions
+	}
+	for _, mapped := range f.Mapped {
+		if positions := mapped.TermPositions(term, index); positions != nil {
+			return positions
+		}
+	}
+	return nil
+}
+
+func (f *FieldIndex) Length(index uint32) uint32 {
+	if length, exists := f.Lengths[index]; exists || len(f.Mapped) == 0 {
+		return length
+	}
+	for _, mapped := range f.Mapped {
+		if length, exists := mapped.Length(index); exists {
+			return length
+		}
+	}
+	return 0
+}
+
+// IsMapped reports whether a mapped dump of the field has the term
+func (f *FieldIndex) IsMapped(term string) bool {
+	for _, mapped := range f.Mapped {
+		if _, exists := mapped.Entry(term); exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of the terms of the field, the terms shared by the in-memory indexes and
+// the mapped dumps are counted once per dump
+func (f *FieldIndex) Len() int {
+	size := len(f.Indexes)
+	for _, mapped := range f.Mapped {
+		size += mapped.Len()
+	}
+	return size
+}
+
+// Terms returns the terms of the field in no particular order
+func (f *FieldIndex) Terms() []string {
+	if len(f.Mapped) == 0 {
+		terms := make([]string, 0, len(f.Indexes))
+		for term := range f.Indexes {
+			terms = append(terms, term)
+		}
+		return terms
+	}
+	unique := make(map[string]bool, f.Len())
+	for term := range f.Indexes {
+		unique[term] = true
+	}
+	for _, mapped := range f.Mapped {
+		for _, entry := range mapped.Dictionary {
+			unique[entry.Term] = true
+		}
+	}
+	terms := make([]string, 0, len(unique))
+	for term := range unique {
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// DocumentLengths returns the lengths of all the documents of the field
+func (f *FieldIndex) DocumentLengths() map[uint32]uint32 {
+	if len(f.Mapped) == 0 {
+		return f.Lengths
+	}
+	lengths := make(map[uint32]uint32, len(f.Lengths))
+	for _, mapped := range f.Mapped {
+		for n, index := range mapped.Documents {
+			lengths[index+mapped.Base] = mapped.Lengths[n]
+		}
+	}
+	for index, length := range f.Lengths {
+		lengths[index] = length
+	}
+	return lengths
+}
+
+// Merge moves the postings of the other field into the field, the document indexes of the other
+// field are shifted by the base
+func (f *FieldIndex) Merge(other *FieldIndex, base uint32) {
+	for term, bitmap := range other.Indexes {
+		shifted := roaring.AddOffset(bitmap, base)
+		if indexes, exists := f.Indexes[term]; exists {
+			indexes.Or(shifted)
+		} else {
+			f.Indexes[term] = shifted
+			f.Positions[term] = make(map[uint32][]uint32, len(other.Positions[term]))
+		}
+		for index, positions := range other.Positions[term] {
+			f.Positions[term][index+base] = positions
+		}
+	}
+	for index, length := range other.Lengths {
+		f.Lengths[index+base] = length
+	}
+	for _, mapped := range other.Mapped {
+		mapped.Rebase(mapped.Base + base)
+		f.Mapped = append(f.Mapped, mapped)
+	}
+	f.TotalLength += other.TotalLength
+}
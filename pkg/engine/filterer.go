@@ -7,6 +7,7 @@ import (
 type FilterInterface interface {
 	Lowercase(tokens []string) []string
 	RemoveStopWords(tokens []string) []string
+	IsStopWord(token string) bool
 }
 
 type Filterer struct {
@@ -131,9 +132,14 @@ func (f *Filterer) RemoveStopWords(tokens []string) []string {
 	newTokens := make([]string, 0, len(tokens))
 	for idx := range tokens {
 		token := tokens[idx]
-		if _, exist := f.StopWords[token]; !exist {
+		if !f.IsStopWord(token) {
 			newTokens = append(newTokens, token)
 		}
 	}
 	return newTokens
 }
+
+func (f *Filterer) IsStopWord(token string) bool {
+	_, exist := f.StopWords[token]
+	return exist
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"html"
+	"strings"
+)
+
+const (
+	DefaultPreTag      = "<em>"
+	DefaultPostTag     = "</em>"
+	DefaultSnippetSize = 30
+	Ellipsis           = "..."
+)
+
+type HighlighterInterface interface {
+	Highlight(text string, tokens []Token, terms map[string]bool) string
+	Snippet(text string, words []Token, tokens []Token, terms map[string]bool) string
+}
+
+// Highlighter wraps the matched words with the PreTag and PostTag markers. The text between the
+// markers is HTML escaped, so the marked text is safe to render as HTML. SnippetSize is the number of
+// words of the snippets.
+type Highlighter struct {
+	PreTag      string
+	PostTag     string
+	SnippetSize int
+}
+
+func NewHighlighter(preTag string, postTag string, snippetSize int) *Highlighter {
+	return &Highlighter{
+		PreTag:      preTag,
+		PostTag:     postTag,
+		SnippetSize: snippetSize,
+	}
+}
+
+// Highlight marks the analyzed tokens of the text whose terms are within the given terms
+func (h *Highlighter) Highlight(text string, tokens []Token, terms map[string]bool) string {
+	return h.mark(text, 0, len(text), tokens, terms)
+}
+
+// Snippet returns the window of SnippetSize words containing the highest number of distinct matched
+// terms with the matched words marked. The words are the raw tokens of the text (including the stop
+// words) and the tokens are the analyzed ones.
+func (h *Highlighter) Snippet(text string, words []Token, tokens []Token, terms map[string]bool) string {
+	if len(words) == 0 {
+		return html.EscapeString(text)
+	}
+	matches := make([]Token, 0)
+	for _, token := range tokens {
+		if terms[token.Term] {
+			matches = append(matches, token)
+		}
+	}
+
+	// Sliding the window over the matched tokens to find the best starting word
+	best, bestDistinct, bestTotal := uint32(0), 0, 0
+	counts := make(map[string]int)
+	left := 0
+	for right := range matches {
+		counts[matches[right].Term]++
+		for matches[right].Position-matches[left].Position >= uint32(h.SnippetSize) {
+			counts[matches[left].Term]--
+			if counts[matches[left].Term] == 0 {
+				delete(counts, matches[left].Term)
+			}
+			left++
+		}
+		if total := right - left + 1; len(counts) > bestDistinct || (len(counts) == bestDistinct && total > bestTotal) {
+			best, bestDistinct, bestTotal = matches[left].Position, len(counts), total
+		}
+	}
+
+	// Moving the window back when it would run past the end of the text
+	last := len(words) - 1
+	if int(best)+h.SnippetSize > len(words) {
+		best = uint32(MaxInt(0, len(words)-h.SnippetSize))
+	}
+	end := MinInt(int(best)+h.SnippetSize-1, last)
+
+	start, stop := 0, len(text)
+	if best > 0 {
+		start = words[best].Start
+	}
+	if end < last {
+		stop = words[end].End
+	}
+	snippet := h.mark(text, start, stop, tokens, terms)
+	if best > 0 {
+		snippet = Ellipsis + snippet
+	}
+	if end < last {
+		snippet = snippet + Ellipsis
+	}
+	return snippet
+}
+
+func (h *Highlighter) mark(text string, start int, stop int, tokens []Token, terms map[string]bool) string {
+	var builder strings.Builder
+	offset := start
+	for _, token := range tokens {
+		if token.Start < start || token.End > stop || !terms[token.Term] {
+			continue
+		}
+		builder.WriteString(html.EscapeString(text[offset:token.Start]))
+		builder.WriteString(h.PreTag)
+		builder.WriteString(html.EscapeString(text[token.Start:token.End]))
+		builder.WriteString(h.PostTag)
+		offset = token.End
+	}
+	builder.WriteString(html.EscapeString(text[offset:stop]))
+	return builder.String()
+}
+
+// HighlightTerms returns the terms to highlight within the field from the terms of the query
+func HighlightTerms(terms []QueryTerm, field string) map[string]bool {
+	highlights := make(map[string]bool)
+	for _, term := range terms {
+		if term.Field == field || (term.Field == "" && IsDefaultField(field)) {
+			highlights[term.Term] = true
+		}
+	}
+	return highlights
+}
+
+// HighlightResult fills the highlighted title and the snippet of the search result
+func (i *Indexer) HighlightResult(result *SearchResult, terms []QueryTerm) {
+	titleTerms := HighlightTerms(terms, TitleField)
+	result.HighlightedTitle = i.Highlighter.Highlight(result.Title, i.AnalyzeTokens(result.Title), titleTerms)
+
+	abstractTerms := HighlightTerms(terms, AbstractField)
+	words := i.Tokenizer.TokenizeWithOffsets(result.Abstract)
+	result.Snippet = i.Highlighter.Snippet(result.Abstract, words, i.AnalyzeTokens(result.Abstract), abstractTerms)
+}
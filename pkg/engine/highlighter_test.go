@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	indexer := NewIndexer()
+	tests := []struct {
+		name     string
+		text     string
+		query    []string
+		expected string
+	}{
+		{"no match", "The first letter", []string{"beta"}, "The first letter"},
+		{"stemmed", "Running runners run", []string{"run"}, "<em>Running</em> runners <em>run</em>"},
+		{"several terms", "alpha is the first letter", []string{"alpha", "letter"}, "<em>alpha</em> is the first <em>letter</em>"},
+		{"escaped", "<script>alert(1)</script> & alpha", []string{"alpha"}, "&lt;script&gt;alert(1)&lt;/script&gt; &amp; <em>alpha</em>"},
+		{"escaped match", "alpha<b>", []string{"alpha", "b"}, "<em>alpha</em>&lt;<em>b</em>&gt;"},
+		// The markers wrap the original words at their offsets
+		{"punctuation", "Alpha, beta; (gamma).", []string{"alpha", "gamma"}, "<em>Alpha</em>, beta; (<em>gamma</em>)."},
+		{"whitespace", "alpha   beta\talpha", []string{"alpha"}, "<em>alpha</em>   beta\t<em>alpha</em>"},
+		{"multibyte", "Café crème café", []string{"café"}, "<em>Café</em> crème <em>café</em>"},
+	}
+	for _, test := range tests {
+		terms := make(map[string]bool)
+		for _, word := range test.query {
+			for _, term := range indexer.Analyze(word) {
+				terms[term] = true
+			}
+		}
+		if highlighted := indexer.Highlighter.Highlight(test.text, indexer.AnalyzeTokens(test.text), terms); highlighted != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, highlighted)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	indexer := NewIndexer()
+	highlighter := NewHighlighter(DefaultPreTag, DefaultPostTag, 3)
+	tests := []struct {
+		name     string
+		text     string
+		query    []string
+		expected string
+	}{
+		{"short text", "alpha beta", []string{"beta"}, "alpha <em>beta</em>"},
+		{"window at the start", "alpha beta gamma delta epsilon", []string{"alpha"}, "<em>alpha</em> beta gamma..."},
+		{"window in the middle", "alpha beta gamma delta epsilon zeta", []string{"gamma", "delta"}, "...<em>gamma</em> <em>delta</em> epsilon..."},
+		{"window at the end", "alpha beta gamma delta epsilon", []string{"epsilon"}, "...gamma delta <em>epsilon</em>"},
+		{"escaped", "a <b> & c", []string{"c"}, "a &lt;b&gt; &amp; <em>c</em>"},
+		{"no words", "<>", []string{"alpha"}, "&lt;&gt;"},
+		{"no match", "alpha beta gamma delta", []string{"zeta"}, "alpha beta gamma..."},
+		// The window having the most distinct terms is preferred over the one having the most matches
+		{"most distinct terms", "alpha alpha alpha red beta gamma alpha green", []string{"alpha", "beta", "gamma"}, "...<em>beta</em> <em>gamma</em> <em>alpha</em>..."},
+		{"most matches", "alpha red blue green alpha alpha red", []string{"alpha"}, "...<em>alpha</em> <em>alpha</em> red"},
+		{"first window", "alpha red green alpha blue", []string{"alpha"}, "<em>alpha</em> red green..."},
+		// The stop words are counted by the size of the window
+		{"stop words", "alpha of the beta red green", []string{"alpha", "beta"}, "<em>alpha</em> of the..."},
+	}
+	for _, test := range tests {
+		terms := make(map[string]bool)
+		for _, word := range test.query {
+			for _, term := range indexer.Analyze(word) {
+				terms[term] = true
+			}
+		}
+		words := indexer.Tokenizer.TokenizeWithOffsets(test.text)
+		snippet := highlighter.Snippet(test.text, words, indexer.AnalyzeTokens(test.text), terms)
+		if snippet != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, snippet)
+		}
+		if strings.Count(snippet, DefaultPreTag) != strings.Count(snippet, DefaultPostTag) {
+			t.Errorf("%s: unbalanced markers in %q", test.name, snippet)
+		}
+	}
+}
+
+func TestSearchHighlights(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	tests := []struct {
+		query   string
+		titles  []string
+		snippet string
+	}{
+		{"python programming", []string{"<em>Python</em>"}, "<em>python</em> is a <em>programming</em> language created by guido van rossum"},
+		// The terms are highlighted within the fields of their scopes
+		{"title:python language", []string{"<em>Python</em>"}, "python is a programming <em>language</em> created by guido van rossum"},
+		{"abstract:python language", []string{"Python"}, "<em>python</em> is a programming <em>language</em> created by guido van rossum"},
+	}
+	for _, test := range tests {
+		results, err := indexer.Search(test.query, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		titles := make([]string, 0, len(results.Results))
+		for _, result := range results.Results {
+			titles = append(titles, result.HighlightedTitle)
+		}
+		if !reflect.DeepEqual(titles, test.titles) {
+			t.Errorf("%s: expected the titles %v, got %v", test.query, test.titles, titles)
+			continue
+		}
+		if snippet := results.Results[0].Snippet; snippet != test.snippet {
+			t.Errorf("%s: expected %q, got %q", test.query, test.snippet, snippet)
+		}
+	}
+}
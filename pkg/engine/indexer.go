@@ -3,6 +3,7 @@ package engine
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,8 +13,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
@@ -22,8 +25,11 @@ import (
 
 const (
 	XmlStreamBufferSize = 1024 * 1024 * 1 // 1MB
-	DocumentCapacity    = 524288          // 2^19
+	DumpIndexBits       = 24
+	MaxDumpDocuments    = 1 << DumpIndexBits
+	BatchSize           = 1024
 	PageSize            = 25
+	ScoreCheckInterval  = 1024
 )
 
 type Processed struct {
@@ -31,11 +37,15 @@ type Processed struct {
 	Unit     string  `json:"unit"`
 }
 
+// SearchResult is a matched document. HighlightedTitle and Snippet have the matched words wrapped with
+// the markers of the Highlighter, the snippet is the best window of the abstract.
 type SearchResult struct {
-	Url      string  `json:"url"`
-	Rank     float64 `json:"rank"`
-	Title    string  `json:"title"`
-	Abstract string  `json:"abstract"`
+	Url              string  `json:"url"`
+	Rank             float64 `json:"rank"`
+	Title            string  `json:"title"`
+	Abstract         string  `json:"abstract"`
+	HighlightedTitle string  `json:"highlighted_title"`
+	Snippet          string  `json:"snippet"`
 }
 
 type SearchResults struct {
@@ -44,6 +54,22 @@ type SearchResults struct {
 	CurrentPage     int            `json:"current_page"`
 	NumberOfPages   int            `json:"number_of_pages"`
 	Results         []SearchResult `json:"results"`
+	Suggestion      string         `json:"suggestion,omitempty"`
+	TimedOut        bool           `json:"timed_out,omitempty"`
+}
+
+// IndexDump is the on-disk representation of the indexes. Vocabulary maps the surface words to
+// their stems for the fuzzy queries.
+type IndexDump struct {
+	Fields     map[string]FieldDump `json:"fields"`
+	Vocabulary map[string]string    `json:"vocabulary"`
+}
+
+// FieldDump is the on-disk representation of a field index. Positions[token][n] holds the positions
+// of the token within the n-th document of Indexes[token] (in ascending document order).
+type FieldDump struct {
+	Indexes   map[string][]uint32   `json:"indexes"`
+	Positions map[string][][]uint32 `json:"positions"`
 }
 
 type WikiXMLDoc struct {
@@ -56,42 +82,133 @@ type WikiXMLDoc struct {
 type IndexerInterface interface {
 	DownloadWikimediaDump(path string, url string) error
 	UncompressWikimediaDump(path string) error
+	NewEmptyIndexer() *Indexer
 	LoadWikimediaDump(path string, save bool, indexPath string, dataPath string) error
 	LoadIndexDump(path string) error
+	LoadBinaryIndexDump(path string) error
+	LoadJSONIndexDump(path string) error
 	LoadDataDump(path string) error
 	SaveIndexDump(path string) error
+	SaveBinaryIndexDump(path string) error
+	SaveJSONIndexDump(path string) error
 	SaveDataDump(path string) error
 	IsFileExists(path string) bool
 	Analyze(s string) []string
-	AddIndex(tokens []string, index uint32)
-	AddIndexesAsync(documents []WikiXMLDoc, wg *sync.WaitGroup)
-	Search(s string) SearchResults
+	AnalyzeTokens(s string) []Token
+	AddIndex(field string, tokens []Token, index uint32)
+	AddWords(words map[string]string)
+	Modified()
+	AddIndexesAsync(batches <-chan []WikiXMLDoc, segment *Segment, wg *sync.WaitGroup)
+	MergeSegments(segments []*Segment)
+	DocumentFrequency(term string) uint64
+	SearchFields(field string) []*FieldIndex
+	TermBitmap(field string, term string) *roaring.Bitmap
+	MappedBitmap(term string) *roaring.Bitmap
+	OpenIndexDump(path string) error
+	Close() error
+	Merge(other *Indexer, base uint32) error
+	TermDictionary(field string) *Dictionary
+	NumberOfDocuments() uint64
+	AllDocuments() *roaring.Bitmap
+	Search(s string, page uint32) (SearchResults, error)
+	SearchContext(ctx context.Context, s string, page uint32) (SearchResults, error)
+	BuildCompletions()
+	BuildFuzzyTree()
+	Complete(prefix string, limit int) CompletionResults
+	Live(rb *roaring.Bitmap) *roaring.Bitmap
 }
 
+// Indexer keeps the postings of every field in Fields, while Indexes is the union of the DefaultFields
+// postings used by the queries without a field scope. SearchMutex is held for reading by the queries and
+// the dump savers, and for writing by the loaders and the document modifications, so the documents can
+// be indexed while the indexer is being searched. The deleted documents are kept in Deleted, and the
+// documents added since the last flush of the segment store are kept in Buffered, and Documents has the
+// indexes of the documents of Data. The document
+// modifications are recorded by the Log before they are applied, if there is a Log. LogMutex serializes
+// the modifications with the rotations of the Log, and it is acquired before the SearchMutex. Generation is
+// advanced when a term is added to or finally removed from a field, so the cached Dictionaries are
+// rebuilt, and it is the first field to stay aligned for the atomic operations.
 type Indexer struct {
-	Data       map[uint32]WikiXMLDoc
-	Indexes    map[string]*roaring.Bitmap
-	Tokenizer  *Tokenizer
-	Filterer   *Filterer
-	Stemmer    *Stemmer
-	Mutex      sync.Mutex
-	Cores      int
-	Multiplier int
+	Generation      uint64
+	Data            map[uint32]WikiXMLDoc
+	Documents       *roaring.Bitmap
+	Urls            map[string]uint32
+	Deleted         *roaring.Bitmap
+	Buffered        *roaring.Bitmap
+	Log             *WriteAheadLog
+	NextIndex       uint32
+	Indexes         map[string]*roaring.Bitmap
+	Fields          map[string]*FieldIndex
+	Dictionaries    map[string]*Dictionary
+	Vocabulary      map[string]string
+	Mapped          []*MappedIndex
+	BKTree          *BKTree
+	PendingWords    []string
+	Tokenizer       *Tokenizer
+	Filterer        *Filterer
+	Stemmer         *Stemmer
+	Ranker          *BM25
+	Suggester       *Suggester
+	Completer       *Completer
+	Highlighter     *Highlighter
+	Mutex           sync.Mutex
+	DictionaryMutex sync.Mutex
+	SearchMutex     sync.RWMutex
+	LogMutex        sync.Mutex
+	MaxExpansions   int
+	Fuzziness       int
+	Cores           int
+	Multiplier      int
 }
 
 func NewIndexer() *Indexer {
-	return &Indexer{
-		Data:       map[uint32]WikiXMLDoc{},
-		Indexes:    map[string]*roaring.Bitmap{},
-		Tokenizer:  NewTokenizer(),
-		Filterer:   NewFilterer(),
-		Stemmer:    NewStemmer(),
-		Mutex:      sync.Mutex{},
-		Cores:      runtime.NumCPU(),
-		Multiplier: 2,
-	}
+	indexer := &Indexer{
+		Data:            map[uint32]WikiXMLDoc{},
+		Documents:       roaring.NewBitmap(),
+		Urls:            nil,
+		Deleted:         roaring.NewBitmap(),
+		Buffered:        roaring.NewBitmap(),
+		Log:             nil,
+		NextIndex:       0,
+		Indexes:         map[string]*roaring.Bitmap{},
+		Fields:          NewFieldIndexes(),
+		Dictionaries:    map[string]*Dictionary{},
+		Vocabulary:      map[string]string{},
+		BKTree:          nil,
+		Tokenizer:       NewTokenizer(),
+		Filterer:        NewFilterer(),
+		Stemmer:         NewStemmer(),
+		Ranker:          NewBM25(DefaultK1, DefaultB),
+		Completer:       NewCompleter(),
+		Highlighter:     NewHighlighter(DefaultPreTag, DefaultPostTag, DefaultSnippetSize),
+		Mutex:           sync.Mutex{},
+		DictionaryMutex: sync.Mutex{},
+		SearchMutex:     sync.RWMutex{},
+		LogMutex:        sync.Mutex{},
+		MaxExpansions:   DefaultMaxExpansions,
+		Fuzziness:       0,
+		Cores:           runtime.NumCPU(),
+		Multiplier:      2,
+	}
+	indexer.Suggester = NewSuggester(indexer, DefaultSuggestionThreshold)
+	return indexer
+}
+
+// NewEmptyIndexer returns an empty indexer having the same ranking, query and highlighting settings
+func (i *Indexer) NewEmptyIndexer() *Indexer {
+	indexer := NewIndexer()
+	indexer.Ranker = i.Ranker
+	indexer.Highlighter = i.Highlighter
+	indexer.MaxExpansions = i.MaxExpansions
+	indexer.Fuzziness = i.Fuzziness
+	indexer.Cores = i.Cores
+	indexer.Multiplier = i.Multiplier
+	indexer.Suggester.Threshold = i.Suggester.Threshold
+	return indexer
 }
 
+// LoadWikimediaDump indexes the documents of the XML dump and saves the dumps if save is set. The
+// completions are not built, since the dumps of several files are usually merged first.
 func (i *Indexer) LoadWikimediaDump(path string, save bool, indexPath string, dataPath string) error {
 
 	t0 := time.Now()
@@ -109,11 +226,25 @@ func (i *Indexer) LoadWikimediaDump(path string, save bool, indexPath string, da
 		}
 	}(f)
 
-	// Phase 1: Parsing the XML file
+	// Phase 1: Parsing the XML file and indexing the batches of documents concurrently. The batches
+	// channel is bounded, so the parser waits for the workers instead of buffering the whole file.
+	// Every worker indexes into its own segment, and the segments are merged at the end.
 	t1 := time.Now()
+	var wg sync.WaitGroup
+
+	workers := i.Cores * i.Multiplier
+	runtime.GOMAXPROCS(workers)
+	batches := make(chan []WikiXMLDoc, workers)
+	segments := make([]*Segment, workers)
+	wg.Add(workers)
+	for n := 0; n < workers; n++ {
+		segments[n] = NewSegment()
+		go i.AddIndexesAsync(batches, segments[n], &wg)
+	}
+
 	buffer := bufio.NewReaderSize(f, XmlStreamBufferSize)
 	parser := xmlparser.NewXMLParser(buffer, "doc")
-	documents := make([]WikiXMLDoc, 0, DocumentCapacity)
+	batch := make([]WikiXMLDoc, 0, BatchSize)
 	index := uint32(0)
 
 	for xmlElement := range parser.Stream() {
@@ -124,41 +255,29 @@ func (i *Indexer) LoadWikimediaDump(path string, save bool, indexPath string, da
 				Url:      xmlElement.Childs["url"][0].InnerText,
 				Abstract: xmlElement.Childs["abstract"][0].InnerText,
 			}
-			documents = append(documents, doc)
+			batch = append(batch, doc)
+			i.SearchMutex.Lock()
 			i.Data[index] = doc
+			i.Documents.Add(index)
+			i.SearchMutex.Unlock()
 			index++
+			if len(batch) == BatchSize {
+				batches <- batch
+				batch = make([]WikiXMLDoc, 0, BatchSize)
+			}
 		}
 	}
-	fmt.Printf("Parsing XML file took %f seconds\n", time.Since(t1).Seconds())
-
-	// Phase 2: Creating indexes concurrently
-	t2 := time.Now()
-	var chunks [][]WikiXMLDoc
-	var wg sync.WaitGroup
-
-	numberOfDocuments := len(documents)
-	fmt.Printf("There are %d documents in the file %s\n", numberOfDocuments, path)
-
-	workers := i.Cores * i.Multiplier
-	runtime.GOMAXPROCS(workers)
-	chunkSize := (numberOfDocuments + workers - 1) / workers
-
-	for i := 0; i < numberOfDocuments; i += chunkSize {
-		end := i + chunkSize
-		if end > numberOfDocuments {
-			end = numberOfDocuments
-		}
-		chunks = append(chunks, documents[i:end])
-	}
-	wg.Add(len(chunks))
-	for idx := range chunks {
-		go i.AddIndexesAsync(chunks[idx], &wg)
+	if len(batch) > 0 {
+		batches <- batch
 	}
+	close(batches)
 	wg.Wait()
-	fmt.Printf("Indexing documents took %f seconds\n", time.Since(t2).Seconds())
+	i.MergeSegments(segments)
+	fmt.Printf("There are %d documents in the file %s\n", index, path)
+	fmt.Printf("Parsing and indexing documents took %f seconds\n", time.Since(t1).Seconds())
 
 	if save {
-		// Phase 3: Saving concurrently the index and data dump into files
+		// Phase 2: Saving concurrently the index and data dump into files
 		workers := 2
 		done := make(chan bool)
 		errors := make(chan error)
@@ -195,12 +314,24 @@ func (i *Indexer) LoadWikimediaDump(path string, save bool, indexPath string, da
 	return nil
 }
 
+// LoadIndexDump loads either a binary or a JSON index dump, the format is detected by the magic bytes
 func (i *Indexer) LoadIndexDump(path string) error {
 	t0 := time.Now()
 	defer func(t0 time.Time) {
 		fmt.Printf("Loading indexes dump took %f seconds\n", time.Since(t0).Seconds())
 	}(t0)
 
+	isBinary, err := IsBinaryIndexDump(path)
+	if err != nil {
+		return err
+	}
+	if isBinary {
+		return i.LoadBinaryIndexDump(path)
+	}
+	return i.LoadJSONIndexDump(path)
+}
+
+func (i *Indexer) LoadJSONIndexDump(path string) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -216,17 +347,96 @@ func (i *Indexer) LoadIndexDump(path string) error {
 		return err
 	}
 
-	var indexes map[string][]uint32
-	if err = json.Unmarshal(bytes, &indexes); err != nil {
+	var dump IndexDump
+	if err = json.Unmarshal(bytes, &dump); err != nil {
 		return err
 	}
+	if dump.Fields == nil {
+		return fmt.Errorf("index dump %s has an outdated format, it should be re-indexed", path)
+	}
 
-	for token, idx := range indexes {
-		i.Indexes[token] = roaring.BitmapOf(idx...)
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	for name, fieldDump := range dump.Fields {
+		field, exists := i.Fields[name]
+		if !exists {
+			return fmt.Errorf("index dump %s has an unknown field %s", path, name)
+		}
+		for token, idx := range fieldDump.Indexes {
+			positions := fieldDump.Positions[token]
+			if len(positions) != len(idx) {
+				return fmt.Errorf("index dump %s is corrupted for token %s of the field %s", path, token, name)
+			}
+			field.Indexes[token] = roaring.BitmapOf(idx...)
+			field.Positions[token] = make(map[uint32][]uint32, len(idx))
+			for n, index := range idx {
+				field.Positions[token][index] = positions[n]
+				field.Lengths[index] += uint32(len(positions[n]))
+				field.TotalLength += uint64(len(positions[n]))
+			}
+		}
+	}
+
+	i.AddWords(dump.Vocabulary)
+	i.Modified()
+
+	i.BuildDefaultIndexes()
+	return nil
+}
+
+// BuildDefaultIndexes rebuilds the union of the DefaultFields indexes after loading the fields
+func (i *Indexer) BuildDefaultIndexes() {
+	for _, name := range DefaultFields {
+		for token, idx := range i.Fields[name].Indexes {
+			if indexes, exists := i.Indexes[token]; exists {
+				indexes.Or(idx)
+			} else {
+				i.Indexes[token] = idx.Clone()
+			}
+		}
+	}
+}
+
+// DumpBase returns the first document index of the dump, so the documents of the dumps loaded together
+// have globally unique indexes
+func DumpBase(dump int) uint32 {
+	return uint32(dump) << DumpIndexBits
+}
+
+// Merge moves the documents and the indexes of the other indexer into the indexer, the document
+// indexes of the other indexer are shifted by the base, so they must be below MaxDumpDocuments
+func (i *Indexer) Merge(other *Indexer, base uint32) error {
+	for index := range other.Data {
+		if index >= MaxDumpDocuments {
+			return fmt.Errorf("document index %d exceeds the maximum number of documents of a dump %d", index, MaxDumpDocuments)
+		}
 	}
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	for index, doc := range other.Data {
+		doc.Index = index + base
+		i.Data[doc.Index] = doc
+		i.Documents.Add(doc.Index)
+	}
+	i.AddWords(other.Vocabulary)
+	for name, field := range other.Fields {
+		i.Fields[name].Merge(field, base)
+	}
+	i.Modified()
+
+	for term, bitmap := range other.Indexes {
+		shifted := roaring.AddOffset(bitmap, base)
+		if indexes, exists := i.Indexes[term]; exists {
+			indexes.Or(shifted)
+		} else {
+			i.Indexes[term] = shifted
+		}
+	}
+	i.Mapped = append(i.Mapped, other.Mapped...)
 	return nil
 }
 
+// LoadDataDump loads the documents of the data dump, BuildCompletions has to be called afterwards
 func (i *Indexer) LoadDataDump(path string) error {
 	t0 := time.Now()
 	defer func(t0 time.Time) {
@@ -252,7 +462,14 @@ func (i *Indexer) LoadDataDump(path string) error {
 	if err = json.Unmarshal(bytes, &data); err != nil {
 		return err
 	}
+	documents := roaring.NewBitmap()
+	for index := range data {
+		documents.Add(index)
+	}
+	i.SearchMutex.Lock()
 	i.Data = data
+	i.Documents = documents
+	i.SearchMutex.Unlock()
 	return nil
 }
 
@@ -263,26 +480,53 @@ func (i *Indexer) IsFileExists(path string) bool {
 	return true
 }
 
+// SaveIndexDump saves the indexes in the JSON format if the path has the JSON extension, and in the
+// binary format otherwise
 func (i *Indexer) SaveIndexDump(path string) error {
 	t0 := time.Now()
 	defer func(t0 time.Time) {
 		fmt.Printf("Saving indexes dump into the file took %f seconds\n", time.Since(t0).Seconds())
 	}(t0)
 
-	indexes := make(map[string][]uint32, 0)
-	for token, idx := range i.Indexes {
-		indexes[token] = idx.ToArray()
+	if strings.EqualFold(filepath.Ext(path), JSONExtension) {
+		return i.SaveJSONIndexDump(path)
 	}
+	return i.SaveBinaryIndexDump(path)
+}
 
-	bytes, err := json.Marshal(&indexes)
-	if err != nil {
-		return err
+func (i *Indexer) SaveJSONIndexDump(path string) error {
+	i.SearchMutex.RLock()
+	defer i.SearchMutex.RUnlock()
+	dump := IndexDump{
+		Fields:     make(map[string]FieldDump, len(i.Fields)),
+		Vocabulary: i.Vocabulary,
+	}
+	for name, field := range i.Fields {
+		terms := field.Terms()
+		fieldDump := FieldDump{
+			Indexes:   make(map[string][]uint32, len(terms)),
+			Positions: make(map[string][][]uint32, len(terms)),
+		}
+		for _, token := range terms {
+			indexes := field.Bitmap(token).ToArray()
+			positions := make([][]uint32, len(indexes))
+			for n, index := range indexes {
+				positions[n] = field.TermPositions(token, index)
+			}
+			fieldDump.Indexes[token] = indexes
+			fieldDump.Positions[token] = positions
+		}
+		dump.Fields[name] = fieldDump
 	}
 
-	if err = ioutil.WriteFile(path, bytes, 0644); err != nil {
+	bytes, err := json.Marshal(&dump)
+	if err != nil {
 		return err
 	}
-	return nil
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(bytes)
+		return err
+	})
 }
 
 func (i *Indexer) SaveDataDump(path string) error {
@@ -290,16 +534,17 @@ func (i *Indexer) SaveDataDump(path string) error {
 	defer func(t0 time.Time) {
 		fmt.Printf("Saving data dump into the file took %f seconds\n", time.Since(t0).Seconds())
 	}(t0)
+	i.SearchMutex.RLock()
+	defer i.SearchMutex.RUnlock()
 
 	bytes, err := json.Marshal(&i.Data)
 	if err != nil {
 		return err
 	}
-
-	if err = ioutil.WriteFile(path, bytes, 0644); err != nil {
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(bytes)
 		return err
-	}
-	return nil
+	})
 }
 
 func (i *Indexer) Analyze(s string) []string {
@@ -310,88 +555,213 @@ func (i *Indexer) Analyze(s string) []string {
 	return tokens
 }
 
-func (i *Indexer) AddIndex(tokens []string, index uint32) {
+// AnalyzeTokens runs the same pipeline as Analyze while keeping the position of every token
+func (i *Indexer) AnalyzeTokens(s string) []Token {
+	words := i.Tokenizer.TokenizeWithOffsets(s)
+	tokens := make([]Token, 0, len(words))
+	for idx := range words {
+		word := strings.ToLower(words[idx].Word)
+		if i.Filterer.IsStopWord(word) {
+			continue
+		}
+		if stemmed, err := i.Stemmer.StemToken(word); err == nil {
+			tokens = append(tokens, Token{
+				Term:     stemmed,
+				Word:     word,
+				Position: words[idx].Position,
+				Start:    words[idx].Start,
+				End:      words[idx].End,
+			})
+		}
+	}
+	return tokens
+}
+
+// AddIndex adds the tokens of the document into the postings of the field. Mutex serializes the
+// concurrent calls, while the SearchMutex has to be held for writing if the indexer is being searched.
+func (i *Indexer) AddIndex(field string, tokens []Token, index uint32) {
+	positions := make(map[string][]uint32, len(tokens))
+	words := make(map[string]string, len(tokens))
 	for idx := range tokens {
 		token := tokens[idx]
+		positions[token.Term] = append(positions[token.Term], token.Position)
+		words[token.Word] = token.Term
+	}
+	fieldIndex := i.Fields[field]
+	isDefault := IsDefaultField(field)
+
+	i.Mutex.Lock()
+	fieldIndex.Lengths[index] = uint32(len(tokens))
+	fieldIndex.TotalLength += uint64(len(tokens))
+	i.AddWords(words)
+	i.Mutex.Unlock()
+
+	for token, position := range positions {
 		i.Mutex.Lock()
-		if indexes, exists := i.Indexes[token]; exists {
-			if !indexes.Contains(index) {
+		if indexes, exists := fieldIndex.Indexes[token]; exists {
+			indexes.Add(index)
+		} else {
+			fieldIndex.Indexes[token] = roaring.BitmapOf(index)
+			fieldIndex.Positions[token] = map[uint32][]uint32{}
+			if !fieldIndex.IsMapped(token) {
+				i.Modified()
+			}
+		}
+		fieldIndex.Positions[token][index] = position
+		if isDefault {
+			if indexes, exists := i.Indexes[token]; exists {
 				indexes.Add(index)
-				i.Indexes[token] = indexes
+			} else {
+				i.Indexes[token] = roaring.BitmapOf(index)
 			}
-		} else {
-			i.Indexes[token] = roaring.BitmapOf(index)
 		}
 		i.Mutex.Unlock()
 	}
 }
 
-func (i *Indexer) Search(s string, page uint32) SearchResults {
+// AddWords adds the words with their stems to the vocabulary. The words new to the vocabulary are
+// queued to be inserted into the BK-tree, if it has been built already. Like AddIndex, the SearchMutex
+// has to be held for writing if the indexer is being searched.
+func (i *Indexer) AddWords(words map[string]string) {
+	for word, stem := range words {
+		if _, exists := i.Vocabulary[word]; !exists && i.BKTree != nil {
+			i.PendingWords = append(i.PendingWords, word)
+		}
+		i.Vocabulary[word] = stem
+	}
+}
+
+// Modified advances the Generation after a change of the terms of the fields
+func (i *Indexer) Modified() {
+	atomic.AddUint64(&i.Generation, 1)
+}
+
+// SearchFields returns the field indexes to search for the given field scope
+func (i *Indexer) SearchFields(field string) []*FieldIndex {
+	if field != "" {
+		if fieldIndex, exists := i.Fields[field]; exists {
+			return []*FieldIndex{fieldIndex}
+		}
+		return nil
+	}
+	fields := make([]*FieldIndex, 0, len(DefaultFields))
+	for _, name := range DefaultFields {
+		fields = append(fields, i.Fields[name])
+	}
+	return fields
+}
+
+// TermBitmap returns the documents containing the term within the field (or within the DefaultFields
+// for an empty field), nil is returned if the term does not exist. The Indexes only have the in-memory
+// postings, so the union of the fields is used if there are mapped dumps.
+func (i *Indexer) TermBitmap(field string, term string) *roaring.Bitmap {
+	if field == "" {
+		if len(i.Mapped) == 0 {
+			return i.Indexes[term]
+		}
+		return i.MappedBitmap(term)
+	}
+	if fieldIndex, exists := i.Fields[field]; exists {
+		return fieldIndex.Bitmap(term)
+	}
+	return nil
+}
+
+func (i *Indexer) NumberOfDocuments() uint64 {
+	return uint64(len(i.Data))
+}
+
+// AllDocuments returns the indexes of all the indexed documents, the bitmap must not be modified
+func (i *Indexer) AllDocuments() *roaring.Bitmap {
+	return i.Documents
+}
+
+func (i *Indexer) Search(s string, page uint32) (SearchResults, error) {
+	return i.SearchContext(context.Background(), s, page)
+}
+
+// SearchContext stops evaluating and scoring the query once the context is done, the partial results
+// found until then are returned with TimedOut set. The partial results are a subset of the matches
+// ranked among themselves, and the suggestion is skipped.
+func (i *Indexer) SearchContext(ctx context.Context, s string, page uint32) (SearchResults, error) {
 	t0 := time.Now()
+	i.SearchMutex.RLock()
+	defer i.SearchMutex.RUnlock()
+
+	query, err := NewQueryParser(i).Parse(s)
+	if err != nil {
+		return SearchResults{}, err
+	}
 
 	searchResults := make([]SearchResult, 0, int(math.Pow(2, 8)))
 	rb := roaring.NewBitmap()
-	tokens := i.Analyze(s)
-
-	for idx := range tokens {
-		token := tokens[idx]
-		if indexes, exists := i.Indexes[token]; exists {
-			if rb.IsEmpty() {
-				rb = indexes.Clone()
-			}
-			// Parallel ANDing to find the intersection
-			rb = roaring.ParAnd(i.Cores, rb, indexes)
-		}
+	terms := make([]QueryTerm, 0)
+	if query != nil {
+		rb = i.Live(query.Evaluate(ctx, i))
+		terms = UniqueTerms(query.Terms())
 	}
+	scorer := i.NewScorer(terms)
 
-	for _, index := range rb.ToArray() {
+	for n, index := range rb.ToArray() {
+		if n%ScoreCheckInterval == 0 && ctx.Err() != nil {
+			break
+		}
 		if doc, ok := i.Data[index]; ok {
 			searchResults = append(searchResults, SearchResult{
 				Url:      doc.Url,
-				Rank:     1,
+				Rank:     scorer.Score(index),
 				Title:    doc.Title,
 				Abstract: doc.Abstract,
 			})
 		}
 	}
+	// Stable sorting keeps the document order for the results having the same rank
+	sort.SliceStable(searchResults, func(a, b int) bool {
+		return searchResults[a].Rank > searchResults[b].Rank
+	})
 
 	totalResults := len(searchResults)
 	numberOfPages := GetNumberOfPages(totalResults, PageSize)
 	paginationResults := SliceSearchResults(searchResults, int(page))
+	for idx := range paginationResults {
+		i.HighlightResult(&paginationResults[idx], terms)
+	}
 	if int(page) > numberOfPages {
 		page = uint32(numberOfPages)
 	}
 
-	var duration float64
-	elapsed := time.Since(t0)
-	microseconds := elapsed.Microseconds()
-	milliseconds := elapsed.Milliseconds()
-
-	if microseconds > 1000 {
-		duration = float64(milliseconds)
-	} else {
-		duration = float64(microseconds) / 1000.0
+	timedOut := ctx.Err() != nil
+	suggestion := ""
+	if !timedOut {
+		suggestion = i.Suggester.Suggest(ctx, s, len(searchResults))
 	}
+	processed := ElapsedSince(t0)
 
-	fmt.Printf("%d results returned out of (%d documents) in %f milliseconds for phrase: %s\n", len(paginationResults), len(searchResults), duration, s)
+	if timedOut {
+		fmt.Printf("Search stopped after %f milliseconds for phrase: %s: %s\n", processed.Duration, s, ctx.Err().Error())
+	}
+	fmt.Printf("%d results returned out of (%d documents) in %f milliseconds for phrase: %s\n", len(paginationResults), len(searchResults), processed.Duration, s)
 	return SearchResults{
-		Processed: Processed{
-			Duration: duration,
-			Unit:     "milliseconds",
-		},
+		Processed:       processed,
 		NumberOfResults: len(searchResults),
 		Results:         paginationResults,
 		CurrentPage:     int(page),
 		NumberOfPages:   numberOfPages,
-	}
+		Suggestion:      suggestion,
+		TimedOut:        timedOut,
+	}, nil
 }
 
-func (i *Indexer) AddIndexesAsync(documents []WikiXMLDoc, wg *sync.WaitGroup) {
+// AddIndexesAsync indexes the batches of documents into the segment until the batches channel is closed
+func (i *Indexer) AddIndexesAsync(batches <-chan []WikiXMLDoc, segment *Segment, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for idx := range documents {
-		doc := documents[idx]
-		tokens := i.Analyze(fmt.Sprintf("%s %s", doc.Title, doc.Abstract))
-		i.AddIndex(tokens, doc.Index)
+	for documents := range batches {
+		for idx := range documents {
+			doc := documents[idx]
+			segment.AddIndex(TitleField, i.AnalyzeTokens(doc.Title), doc.Index)
+			segment.AddIndex(AbstractField, i.AnalyzeTokens(doc.Abstract), doc.Index)
+			segment.AddIndex(UrlField, i.AnalyzeTokens(UrlPath(doc.Url)), doc.Index)
+		}
 	}
 }
 
@@ -0,0 +1,841 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+const (
+	SyntheticDocuments  = 20000
+	SyntheticVocabulary = 5000
+	SyntheticWords      = 40
+)
+
+// SyntheticCorpus returns documents made of random words with a skewed distribution, so a few words
+// are shared by most of the documents like in the real abstracts
+func SyntheticCorpus(n int) []WikiXMLDoc {
+	random := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(random, 1.1, 1, SyntheticVocabulary-1)
+	words := make([]string, SyntheticVocabulary)
+	for idx := range words {
+		words[idx] = fmt.Sprintf("word%dx", idx)
+	}
+	documents := make([]WikiXMLDoc, n)
+	for idx := range documents {
+		abstract := make([]string, SyntheticWords)
+		for w := range abstract {
+			abstract[w] = words[zipf.Uint64()]
+		}
+		title := words[zipf.Uint64()] + " " + words[zipf.Uint64()]
+		documents[idx] = WikiXMLDoc{
+			Index:    uint32(idx),
+			Title:    title,
+			Url:      "https://en.wikipedia.org/wiki/" + strings.ReplaceAll(title, " ", "_"),
+			Abstract: strings.Join(abstract, " "),
+		}
+	}
+	return documents
+}
+
+// IndexConcurrently splits the documents between the workers, which either share the locked indexer
+// or index into their own segments
+func IndexConcurrently(indexer *Indexer, documents []WikiXMLDoc, segmented bool) {
+	var wg sync.WaitGroup
+	workers := indexer.Cores * indexer.Multiplier
+	batches := make(chan []WikiXMLDoc, workers)
+	segments := make([]*Segment, workers)
+	wg.Add(workers)
+	for n := 0; n < workers; n++ {
+		if segmented {
+			segments[n] = NewSegment()
+			go indexer.AddIndexesAsync(batches, segments[n], &wg)
+			continue
+		}
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, doc := range batch {
+					indexer.AddIndex(TitleField, indexer.AnalyzeTokens(doc.Title), doc.Index)
+					indexer.AddIndex(AbstractField, indexer.AnalyzeTokens(doc.Abstract), doc.Index)
+					indexer.AddIndex(UrlField, indexer.AnalyzeTokens(UrlPath(doc.Url)), doc.Index)
+				}
+			}
+		}()
+	}
+	for start := 0; start < len(documents); start += BatchSize {
+		batches <- documents[start:MinInt(start+BatchSize, len(documents))]
+	}
+	close(batches)
+	wg.Wait()
+	if segmented {
+		indexer.MergeSegments(segments)
+	}
+}
+
+func benchmarkIndexing(b *testing.B, segmented bool) {
+	documents := SyntheticCorpus(SyntheticDocuments)
+	b.ResetTimer()
+	t0 := time.Now()
+	for n := 0; n < b.N; n++ {
+		IndexConcurrently(NewIndexer(), documents, segmented)
+	}
+	b.ReportMetric(float64(len(documents)*b.N)/time.Since(t0).Seconds(), "docs/s")
+}
+
+func BenchmarkIndexingLocked(b *testing.B) {
+	benchmarkIndexing(b, false)
+}
+
+func BenchmarkIndexingSegments(b *testing.B) {
+	benchmarkIndexing(b, true)
+}
+
+// NewTestIndexer adds the documents to a new indexer, the url of a document is derived from its title
+// if it has no url
+func NewTestIndexer(t *testing.T, documents []WikiXMLDoc) *Indexer {
+	indexer := NewIndexer()
+	t.Cleanup(func() { _ = indexer.Close() })
+	for _, doc := range documents {
+		if doc.Url == "" {
+			doc.Url = "https://en.wikipedia.org/wiki/" + strings.ReplaceAll(doc.Title, " ", "_")
+		}
+		if _, err := indexer.AddDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return indexer
+}
+
+// SearchTitles returns the titles of the results of the first page in the order of their ranks
+func SearchTitles(t *testing.T, indexer *Indexer, query string) []string {
+	results, err := indexer.Search(query, 1)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	titles := make([]string, 0, len(results.Results))
+	for _, result := range results.Results {
+		titles = append(titles, result.Title)
+	}
+	return titles
+}
+
+// MatchedTitles returns the sorted titles of the documents matched by the query
+func MatchedTitles(t *testing.T, indexer *Indexer, query string) []string {
+	titles := SearchTitles(t, indexer, query)
+	sort.Strings(titles)
+	return titles
+}
+
+// WriteSyntheticDump writes the documents in the format of the Wiki XML abstract dumps
+func WriteSyntheticDump(path string, documents []WikiXMLDoc) error {
+	var builder strings.Builder
+	builder.WriteString("<feed>\n")
+	for _, doc := range documents {
+		builder.WriteString(fmt.Sprintf("<doc><title>%s</title><url>%s</url><abstract>%s</abstract></doc>\n", doc.Title, doc.Url, doc.Abstract))
+	}
+	builder.WriteString("</feed>\n")
+	return os.WriteFile(path, []byte(builder.String()), 0644)
+}
+
+// SearchUntilDone queries the indexer until the done channel is closed
+func SearchUntilDone(t *testing.T, indexer *Indexer, done <-chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	queries := []string{"word1x", "word2x OR word3x", "\"word1x word2x\"", "title:word4x", "word1*", "word5x -word1x", "word1xx~1"}
+	for n := 0; ; n++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if _, err := indexer.Search(queries[n%len(queries)], 1); err != nil {
+			t.Error(err)
+			return
+		}
+		indexer.Complete("word", 5)
+	}
+}
+
+func TestSearchWhileLoading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abstract.xml")
+	documents := SyntheticCorpus(2000)
+	if err := WriteSyntheticDump(path, documents); err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := NewIndexer()
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for n := 0; n < 2; n++ {
+		go SearchUntilDone(t, indexer, done, &wg)
+	}
+	err := indexer.LoadWikimediaDump(path, false, "", "")
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexer.NumberOfDocuments() != uint64(len(documents)) {
+		t.Fatalf("expected %d documents, got %d", len(documents), indexer.NumberOfDocuments())
+	}
+}
+
+func TestSearchWhileModifying(t *testing.T) {
+	indexer := NewIndexer()
+	documents := SyntheticCorpus(500)
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for n := 0; n < 2; n++ {
+		go SearchUntilDone(t, indexer, done, &wg)
+	}
+	for idx, doc := range documents {
+		doc.Url = fmt.Sprintf("%s_%d", doc.Url, idx)
+		if _, err := indexer.AddDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+		if idx%3 == 0 {
+			doc.Abstract = "updated abstract"
+			if _, err := indexer.UpdateDocument(doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if idx%5 == 0 {
+			if _, err := indexer.DeleteDocument(doc.Url); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	deleted := (len(documents) + 4) / 5
+	if indexer.NumberOfDocuments() != uint64(len(documents)-deleted) {
+		t.Fatalf("expected %d documents, got %d", len(documents)-deleted, indexer.NumberOfDocuments())
+	}
+	results, err := indexer.Search("updated", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The documents updated and not deleted afterwards, i.e. the multiples of 3 but not 15
+	if expected := (len(documents)+2)/3 - (len(documents)+14)/15; results.NumberOfResults != expected {
+		t.Fatalf("expected %d updated documents, got %d", expected, results.NumberOfResults)
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	indexer := NewIndexer()
+	IndexConcurrently(indexer, SyntheticCorpus(2000), true)
+	for _, doc := range SyntheticCorpus(2000) {
+		indexer.Data[doc.Index] = doc
+		indexer.Documents.Add(doc.Index)
+	}
+
+	queries := []string{"word1x", "word2x OR word3x", "\"word1x word2x\"", "title:word4x", "word1*", "word5x -word1x", "-word1x", "word1xx~1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, query := range queries {
+		results, err := indexer.SearchContext(ctx, query, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !results.TimedOut || results.NumberOfResults != 0 {
+			t.Fatalf("%s: expected no results after the cancellation, got %d", query, results.NumberOfResults)
+		}
+	}
+
+	// The partial results stopped at any point are a subset of the matches
+	for n, query := range queries {
+		parsed, err := NewQueryParser(indexer).Parse(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := parsed.Evaluate(context.Background(), indexer)
+		for timeout := time.Duration(0); timeout < 200*time.Microsecond; timeout += 10 * time.Microsecond {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			partial := parsed.Evaluate(ctx, indexer)
+			cancel()
+			if extra := roaring.AndNot(partial, expected); !extra.IsEmpty() {
+				t.Fatalf("%s: %d unexpected partial results after %v", queries[n], extra.GetCardinality(), timeout)
+			}
+		}
+	}
+	if results, err := indexer.SearchContext(context.Background(), "word1x", 1); err != nil || results.TimedOut {
+		t.Fatalf("unexpected timeout without a deadline: %v", err)
+	}
+}
+
+func TestSegmentStore(t *testing.T) {
+	directory := t.TempDir()
+	indexer := NewIndexer()
+	store, err := OpenSegmentStore(directory, indexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents := SyntheticCorpus(MergeFactor * 3)
+	for idx, doc := range documents {
+		doc.Url = fmt.Sprintf("%s_%d", doc.Url, idx)
+		if _, err := indexer.AddDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+		if idx%4 == 0 {
+			doc.Abstract = "updated abstract"
+			if _, err := indexer.UpdateDocument(doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if idx%6 == 0 {
+			if _, err := indexer.DeleteDocument(doc.Url); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if idx%3 == 2 {
+			if err := store.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(store.Manifest.Segments) != MergeFactor {
+		t.Fatalf("expected %d segments, got %d", MergeFactor, len(store.Manifest.Segments))
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Manifest.Segments) != 1 {
+		t.Fatalf("expected 1 merged segment, got %d", len(store.Manifest.Segments))
+	}
+
+	// The documents updated and not deleted afterwards, i.e. the multiples of 4 but not 12
+	live := len(documents) - (len(documents)+5)/6
+	updated := (len(documents)+3)/4 - (len(documents)+11)/12
+	check := func(indexer *Indexer) {
+		if indexer.NumberOfDocuments() != uint64(live) {
+			t.Fatalf("expected %d documents, got %d", live, indexer.NumberOfDocuments())
+		}
+		results, err := indexer.Search("updated", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results.NumberOfResults != updated {
+			t.Fatalf("expected %d updated documents, got %d", updated, results.NumberOfResults)
+		}
+	}
+	check(indexer)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewIndexer()
+	store, err = OpenSegmentStore(directory, reopened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+	if _, err := reopened.AddDocument(WikiXMLDoc{Title: "new", Url: "https://en.wikipedia.org/wiki/New", Abstract: "updated"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if results, _ := reopened.Search("updated", 1); results.NumberOfResults != updated+1 {
+		t.Fatalf("expected %d updated documents, got %d", updated+1, results.NumberOfResults)
+	}
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	directory := t.TempDir()
+	indexer := NewIndexer()
+	store, err := OpenSegmentStore(directory, indexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents := SyntheticCorpus(20)
+	for idx, doc := range documents {
+		doc.Url = fmt.Sprintf("%s_%d", doc.Url, idx)
+		if _, err := indexer.AddDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+		if idx == 9 {
+			if err := store.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if idx%4 == 0 {
+			doc.Abstract = "updated abstract"
+			if _, err := indexer.UpdateDocument(doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if idx%6 == 0 {
+			if _, err := indexer.DeleteDocument(doc.Url); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The crash leaves the store unflushed and a torn record at the end of the log
+	sequences, err := LogSequences(directory)
+	if err != nil || len(sequences) != 1 {
+		t.Fatalf("expected a single log file after the flush, got %v %v", sequences, err)
+	}
+	f, err := os.OpenFile(filepath.Join(directory, fmt.Sprintf(LogFile, sequences[0])), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{42, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	reopened := NewIndexer()
+	store, err = OpenSegmentStore(directory, reopened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	defer store.Close()
+	if reopened.NumberOfDocuments() != indexer.NumberOfDocuments() {
+		t.Fatalf("expected %d documents, got %d", indexer.NumberOfDocuments(), reopened.NumberOfDocuments())
+	}
+	for _, query := range []string{"updated", "word1x", "title:word1x"} {
+		expected, _ := indexer.Search(query, 1)
+		results, err := reopened.Search(query, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results.NumberOfResults != expected.NumberOfResults {
+			t.Fatalf("%s: expected %d results, got %d", query, expected.NumberOfResults, results.NumberOfResults)
+		}
+	}
+}
+
+func TestCrashAfterCompaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation byte
+		flushed   bool
+		documents uint64
+		matched   int
+	}{
+		{"update", LogUpdate, false, MergeFactor, 1},
+		{"flushed update", LogUpdate, true, MergeFactor, 1},
+		{"delete", LogDelete, false, MergeFactor - 1, 0},
+		{"flushed delete", LogDelete, true, MergeFactor - 1, 0},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		indexer := NewIndexer()
+		store, err := OpenSegmentStore(directory, indexer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		documents := SyntheticCorpus(MergeFactor)
+		for idx, doc := range documents {
+			documents[idx].Url = fmt.Sprintf("%s_%d", doc.Url, idx)
+			if _, err := indexer.AddDocument(documents[idx]); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		doc := documents[0]
+		doc.Abstract = "updated abstract"
+		if test.operation == LogUpdate {
+			_, err = indexer.UpdateDocument(doc)
+		} else {
+			_, err = indexer.DeleteDocument(doc.Url)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.flushed {
+			if err := store.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The crash leaves the modification in the log unless it is flushed
+		reopened := NewIndexer()
+		reopenedStore, err := OpenSegmentStore(directory, reopened)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if reopened.NumberOfDocuments() != test.documents {
+			t.Errorf("%s: expected %d documents, got %d", test.name, test.documents, reopened.NumberOfDocuments())
+		}
+		if results, _ := reopened.Search("updated", 1); results.NumberOfResults != test.matched {
+			t.Errorf("%s: expected %d updated documents, got %d", test.name, test.matched, results.NumberOfResults)
+		}
+		_ = reopenedStore.Close()
+		_ = reopened.Close()
+		_ = indexer.Close()
+	}
+}
+
+func TestResumeSegmentStore(t *testing.T) {
+	directory := t.TempDir()
+	indexer := NewIndexer()
+	defer indexer.Close()
+	store, err := OpenSegmentStore(directory, indexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents := SyntheticCorpus(2)
+	if _, err := indexer.AddDocument(documents[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Resume(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if indexer.Log == nil {
+		t.Fatal("expected the write-ahead log to be reopened")
+	}
+	if _, err := indexer.AddDocument(documents[1]); err != nil {
+		t.Fatal(err)
+	}
+	if modifications := store.NumberOfModifications(); modifications != 1 {
+		t.Fatalf("expected 1 flushed modification, got %d", modifications)
+	}
+	// The crash leaves the second document in the log only
+	close(store.Done)
+	store.WaitGroup.Wait()
+
+	reopened := NewIndexer()
+	store, err = OpenSegmentStore(directory, reopened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	defer store.Close()
+	if reopened.NumberOfDocuments() != 2 {
+		t.Fatalf("expected 2 documents, got %d", reopened.NumberOfDocuments())
+	}
+}
+
+func TestSuggestionsIgnoreDeletedDocuments(t *testing.T) {
+	// The postings of the mapped dump keep the deleted documents
+	directory := t.TempDir()
+	documents := []WikiXMLDoc{{Title: "lettre", Url: "https://en.wikipedia.org/wiki/Lettre", Abstract: "une lettre"}}
+	for idx := 0; idx < 12; idx++ {
+		documents = append(documents, WikiXMLDoc{Title: "letter", Url: fmt.Sprintf("https://en.wikipedia.org/wiki/Letter_%d", idx), Abstract: "a letter"})
+	}
+	path, indexPath, dataPath := filepath.Join(directory, "abstract.xml"), filepath.Join(directory, "indexes.idx"), filepath.Join(directory, "data.json")
+	if err := WriteSyntheticDump(path, documents); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewIndexer().LoadWikimediaDump(path, true, indexPath, dataPath); err != nil {
+		t.Fatal(err)
+	}
+	indexer := NewIndexer()
+	defer indexer.Close()
+	if err := indexer.OpenIndexDump(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.LoadDataDump(dataPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if suggestion := indexer.Suggester.Suggest(context.Background(), "lettre", 1); suggestion != "letter" {
+		t.Fatalf("expected the suggestion letter, got %q", suggestion)
+	}
+	for _, doc := range documents[1:] {
+		if _, err := indexer.DeleteDocument(doc.Url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if suggestion := indexer.Suggester.Suggest(context.Background(), "lettre", 1); suggestion != "" {
+		t.Fatalf("expected no suggestion matching only the deleted documents, got %q", suggestion)
+	}
+}
+
+func TestTermDictionaryGeneration(t *testing.T) {
+	indexer := NewIndexer()
+	defer indexer.Close()
+	if _, err := indexer.AddDocument(WikiXMLDoc{Title: "zebra", Url: "https://en.wikipedia.org/wiki/Zebra"}); err != nil {
+		t.Fatal(err)
+	}
+	if terms := indexer.TermDictionary(TitleField).Prefix("zeb", 10); len(terms) != 1 || terms[0] != "zebra" {
+		t.Fatalf("unexpected terms %v", terms)
+	}
+	// The number of the terms is unchanged by replacing the document
+	if _, err := indexer.DeleteDocument("https://en.wikipedia.org/wiki/Zebra"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexer.AddDocument(WikiXMLDoc{Title: "zebu", Url: "https://en.wikipedia.org/wiki/Zebra"}); err != nil {
+		t.Fatal(err)
+	}
+	if terms := indexer.TermDictionary(TitleField).Prefix("zeb", 10); len(terms) != 1 || terms[0] != "zebu" {
+		t.Fatalf("expected the dictionary to be rebuilt, got %v", terms)
+	}
+}
+
+func TestFuzzyTreeInsertsNewWords(t *testing.T) {
+	indexer := NewIndexer()
+	defer indexer.Close()
+	if _, err := indexer.AddDocument(WikiXMLDoc{Title: "zebra", Url: "https://en.wikipedia.org/wiki/Zebra"}); err != nil {
+		t.Fatal(err)
+	}
+	tree := indexer.FuzzyTree()
+	if _, err := indexer.AddDocument(WikiXMLDoc{Title: "quokka", Url: "https://en.wikipedia.org/wiki/Quokka"}); err != nil {
+		t.Fatal(err)
+	}
+	if indexer.FuzzyTree() != tree {
+		t.Fatal("expected the words to be inserted into the existing tree")
+	}
+	if matches := tree.Search("quoka", 1); len(matches) != 1 || matches[0].Word != "quokka" {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+}
+
+func TestReplayFlushedLog(t *testing.T) {
+	directory := t.TempDir()
+	indexer := NewIndexer()
+	defer indexer.Close()
+	store, err := OpenSegmentStore(directory, indexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents := SyntheticCorpus(3)
+	for idx := range documents {
+		documents[idx].Url = fmt.Sprintf("%s_%d", documents[idx].Url, idx)
+		if _, err := indexer.AddDocument(documents[idx]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updated := documents[0]
+	updated.Abstract = "updated abstract"
+	if _, err := indexer.UpdateDocument(updated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexer.DeleteDocument(documents[1].Url); err != nil {
+		t.Fatal(err)
+	}
+	// The url of the deleted document is used by a new document
+	if _, err := indexer.AddDocument(documents[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The crash after writing the manifest leaves the flushed records in the log
+	sequences, err := LogSequences(directory)
+	if err != nil || len(sequences) != 1 {
+		t.Fatalf("expected a single log file, got %v %v", sequences, err)
+	}
+	path := filepath.Join(directory, fmt.Sprintf(LogFile, sequences[0]))
+	records, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, records, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewIndexer()
+	store, err = OpenSegmentStore(directory, reopened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	defer store.Close()
+	if reopened.NumberOfDocuments() != uint64(len(documents)) {
+		t.Fatalf("expected %d documents, got %d", len(documents), reopened.NumberOfDocuments())
+	}
+	for _, doc := range documents {
+		expected, _ := indexer.DocumentIndex(doc.Url)
+		if index, exists := reopened.DocumentIndex(doc.Url); !exists || index != expected {
+			t.Fatalf("%s: expected the index %d, got %d %v", doc.Url, expected, index, exists)
+		}
+	}
+	if results, _ := reopened.Search("updated", 1); results.NumberOfResults != 1 {
+		t.Fatalf("expected 1 updated document, got %d", results.NumberOfResults)
+	}
+}
+
+func TestSearchWhileSyncingLog(t *testing.T) {
+	indexer := NewIndexer()
+	defer indexer.Close()
+	store, err := OpenSegmentStore(t.TempDir(), indexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := indexer.AddDocument(WikiXMLDoc{Title: "alpha", Url: "https://en.wikipedia.org/wiki/Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holding the mutex of the log stalls the append like a slow sync
+	indexer.Log.Mutex.Lock()
+	added := make(chan error, 1)
+	go func() {
+		_, err := indexer.AddDocument(WikiXMLDoc{Title: "beta", Url: "https://en.wikipedia.org/wiki/Beta"})
+		added <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	searched := make(chan error, 1)
+	go func() {
+		_, err := indexer.Search("alpha", 1)
+		searched <- err
+	}()
+	select {
+	case err := <-searched:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the search was blocked by the append to the log")
+	}
+	indexer.Log.Mutex.Unlock()
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeDumps(t *testing.T) {
+	// The first dumps are mapped and the last one is kept in the memory
+	dumps := [][]WikiXMLDoc{
+		ParserDocuments[:2],
+		ParserDocuments[2:],
+		{{Title: "Boa", Abstract: "the boa is a large snake living in america"}},
+	}
+	indexer := NewIndexer()
+	defer indexer.Close()
+	for n, documents := range dumps {
+		dump := NewTestIndexer(t, documents)
+		if n < len(dumps)-1 {
+			dump = OpenTestIndexDump(t, dump)
+		}
+		if err := indexer.Merge(dump, DumpBase(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index, doc := range indexer.Data {
+		if index != doc.Index || index < DumpBase(0) || index >= DumpBase(len(dumps)) {
+			t.Errorf("%s: unexpected index %d", doc.Title, index)
+		}
+	}
+	if _, err := indexer.DeleteDocument("https://en.wikipedia.org/wiki/Perl"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"python", []string{"Python", "Python (snake)"}},
+		{"snake", []string{"Boa", "Cobra", "Python (snake)"}},
+		{"\"large snakes\"", []string{"Boa", "Python (snake)"}},
+		{"asia*", []string{"Cobra", "Python (snake)"}},
+		{"perl", []string{"Ruby"}},
+		{"title:boa OR title:ruby", []string{"Boa", "Ruby"}},
+		{"snake -title:python", []string{"Boa", "Cobra"}},
+	}
+	for _, test := range tests {
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+}
+
+func TestMergeLimit(t *testing.T) {
+	tests := []struct {
+		index  uint32
+		failed bool
+	}{
+		{0, false},
+		{MaxDumpDocuments - 1, false},
+		{MaxDumpDocuments, true},
+	}
+	for _, test := range tests {
+		// The limit applies to the indexes of the documents rather than their number
+		dump := NewIndexer()
+		dump.Data[test.index] = WikiXMLDoc{Index: test.index, Title: "Python", Url: "https://en.wikipedia.org/wiki/Python"}
+		indexer := NewIndexer()
+		if err := indexer.Merge(dump, DumpBase(1)); (err != nil) != test.failed {
+			t.Errorf("%d: unexpected error %v", test.index, err)
+		}
+		if _, merged := indexer.Data[DumpBase(1)+test.index]; merged == test.failed {
+			t.Errorf("%d: expected the document to be merged %t", test.index, !test.failed)
+		}
+	}
+}
+
+func TestStreamingPipeline(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	corpus := SyntheticCorpus(2*BatchSize + 1)
+	queries := []string{"word1x", "word2x OR word3x", "\"word1x word2x\"", "title:word4x", "word1*", "word5x -word1x", "word1xx~1"}
+	tests := []struct {
+		documents  int
+		cores      int
+		multiplier int
+	}{
+		{0, 1, 1},
+		{1, 2, 2},
+		{BatchSize, 1, 1},
+		{BatchSize + 1, 2, 1},
+		{2*BatchSize + 1, 4, 2},
+	}
+	for _, test := range tests {
+		documents := corpus[:test.documents]
+		path := filepath.Join(t.TempDir(), "abstract.xml")
+		if err := WriteSyntheticDump(path, documents); err != nil {
+			t.Fatal(err)
+		}
+		streamed := NewIndexer()
+		streamed.Cores, streamed.Multiplier = test.cores, test.multiplier
+		if err := streamed.LoadWikimediaDump(path, false, "", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// The reference indexer adds the documents one by one
+		indexer := NewIndexer()
+		indexer.Cores, indexer.Multiplier = 1, 1
+		IndexConcurrently(indexer, documents, false)
+		for _, doc := range documents {
+			indexer.Data[doc.Index] = doc
+			indexer.Documents.Add(doc.Index)
+		}
+
+		if !reflect.DeepEqual(streamed.Data, indexer.Data) || !reflect.DeepEqual(streamed.Vocabulary, indexer.Vocabulary) {
+			t.Errorf("%d documents: the data or the vocabulary differs", test.documents)
+		}
+		for _, name := range Fields {
+			field, expected := streamed.Fields[name], indexer.Fields[name]
+			if field.TotalLength != expected.TotalLength || !reflect.DeepEqual(field.Lengths, expected.Lengths) || !reflect.DeepEqual(field.Positions, expected.Positions) {
+				t.Errorf("%d documents: the field %s differs", test.documents, name)
+			}
+		}
+		for _, query := range queries {
+			if titles, expected := SearchTitles(t, streamed, query), SearchTitles(t, indexer, query); !reflect.DeepEqual(titles, expected) {
+				t.Errorf("%d documents: %s: expected %v, got %v", test.documents, query, expected, titles)
+			}
+		}
+		streamed.BuildCompletions()
+		if completions := streamed.Completer.Size; completions != test.documents {
+			t.Errorf("%d documents: expected %d completions, got %d", test.documents, test.documents, completions)
+		}
+	}
+}
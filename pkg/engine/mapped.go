@@ -0,0 +1,321 @@
+package engine
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+type MappedIndexInterface interface {
+	Field(name string) (*MappedField, error)
+	Vocabulary() (map[string]string, error)
+	Close() error
+}
+
+// MappedIndex is a binary index dump mapped into the memory. The pages of the file are loaded by the
+// OS on their first access and they are shared through the page cache by the processes mapping the
+// same file.
+type MappedIndex struct {
+	Path     string
+	Data     []byte
+	Sections map[string]Section
+}
+
+// MappedPosting is a decoded posting of a term. The bitmap refers to the mapped memory, and the
+// positions are decoded once on their first access.
+type MappedPosting struct {
+	Bitmap    *roaring.Bitmap
+	Encoded   []byte
+	Positions map[uint32][]uint32
+	Decoded   sync.Once
+}
+
+// MappedField serves the postings of a field from the mapped index. The dictionary and the lengths
+// are decoded when the index is opened, while the postings are decoded lazily per term and cached.
+// The checksum of the postings section is verified once before the first posting is decoded, so a
+// corrupted section is never decoded. Base is added to the document indexes of the dump, which start
+// from 0 within every dump. Mutex guards the Cache, which is read by the concurrent searches.
+type MappedField struct {
+	Name       string
+	Dictionary []DictionaryEntry
+	Postings   []byte
+	Checksum   uint32
+	Documents  []uint32
+	Lengths    []uint32
+	Cache      map[string]*MappedPosting
+	Base       uint32
+	Mutex      sync.RWMutex
+	Verified   sync.Once
+	Err        error
+}
+
+func OpenMappedIndex(path string) (*MappedIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		if err := f.Close(); err != nil {
+			fmt.Printf("Error closing index file: %s\n", err.Error())
+		}
+	}(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < IndexHeaderSize {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotBinaryDump)
+	}
+	data, err := MapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	sections, err := ReadSectionTable(data)
+	if err != nil {
+		_ = UnmapFile(data)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &MappedIndex{
+		Path:     path,
+		Data:     data,
+		Sections: sections,
+	}, nil
+}
+
+// Close unmaps the index, the bitmaps returned by the mapped fields must not be used afterwards
+func (m *MappedIndex) Close() error {
+	if m.Data == nil {
+		return nil
+	}
+	err := UnmapFile(m.Data)
+	m.Data = nil
+	return err
+}
+
+func (m *MappedIndex) Vocabulary() (map[string]string, error) {
+	b, err := SectionBytes(m.Data, m.Sections, VocabularySection)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeVocabulary(b)
+}
+
+// Field decodes the dictionary and the lengths of the field. The checksum of the postings section is
+// verified by the first use of the postings instead, since it reads the whole section from the disk.
+func (m *MappedIndex) Field(name string) (*MappedField, error) {
+	b, err := SectionBytes(m.Data, m.Sections, LengthsSection+name)
+	if err != nil {
+		return nil, err
+	}
+	documents, lengths, _, err := DecodeLengths(b)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = SectionBytes(m.Data, m.Sections, DictionarySection+name); err != nil {
+		return nil, err
+	}
+	entries, err := DecodeDictionary(b)
+	if err != nil {
+		return nil, err
+	}
+	section, exists := m.Sections[PostingsSection+name]
+	if !exists {
+		return nil, fmt.Errorf("index dump has no section %s", PostingsSection+name)
+	}
+	postings := m.Data[section.Offset : section.Offset+section.Length]
+	for _, entry := range entries {
+		if entry.Offset+entry.Length > uint64(len(postings)) {
+			return nil, fmt.Errorf("index dump %s is corrupted for token %s of the field %s", m.Path, entry.Term, name)
+		}
+	}
+	return &MappedField{
+		Name:       name,
+		Dictionary: entries,
+		Postings:   postings,
+		Checksum:   section.Checksum,
+		Documents:  documents,
+		Lengths:    lengths,
+		Cache:      map[string]*MappedPosting{},
+	}, nil
+}
+
+// Rebase changes the base of the document indexes and drops the decoded postings, the field must not
+// be searched meanwhile
+func (m *MappedField) Rebase(base uint32) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	m.Base = base
+	m.Cache = map[string]*MappedPosting{}
+}
+
+func (m *MappedField) Len() int {
+	return len(m.Dictionary)
+}
+
+// Entry returns the dictionary entry of the term with a binary search over the sorted dictionary
+func (m *MappedField) Entry(term string) (DictionaryEntry, bool) {
+	idx := sort.Search(len(m.Dictionary), func(n int) bool { return m.Dictionary[n].Term >= term })
+	if idx < len(m.Dictionary) && m.Dictionary[idx].Term == term {
+		return m.Dictionary[idx], true
+	}
+	return DictionaryEntry{}, false
+}
+
+// VerifyPostings verifies the checksum of the postings section on its first call
+func (m *MappedField) VerifyPostings() error {
+	m.Verified.Do(func() {
+		if crc32.Checksum(m.Postings, CastagnoliTable) != m.Checksum {
+			m.Err = fmt.Errorf("index dump section %s checksum mismatch", PostingsSection+m.Name)
+		}
+	})
+	return m.Err
+}
+
+// Posting returns the posting of the term or nil if the term does not exist. The postings are decoded
+// without holding the Mutex, and the posting cached first is kept if several searches decode a term.
+func (m *MappedField) Posting(term string) *MappedPosting {
+	m.Mutex.RLock()
+	posting, exists := m.Cache[term]
+	base := m.Base
+	m.Mutex.RUnlock()
+	if exists {
+		return posting
+	}
+	entry, exists := m.Entry(term)
+	if !exists {
+		return nil
+	}
+	if err := m.VerifyPostings(); err != nil {
+		fmt.Printf("Error decoding the posting of the term %s: %s\n", term, err.Error())
+		return nil
+	}
+	serialized, encoded, err := SplitPosting(m.Postings[entry.Offset : entry.Offset+entry.Length])
+	if err != nil {
+		fmt.Printf("Error decoding the posting of the term %s: %s\n", term, err.Error())
+		return nil
+	}
+	// FromBuffer does not copy the containers, they are copied on write instead
+	bitmap := roaring.NewBitmap()
+	if _, err := bitmap.FromBuffer(serialized); err != nil {
+		fmt.Printf("Error decoding the posting of the term %s: %s\n", term, err.Error())
+		return nil
+	}
+	if base != 0 {
+		bitmap = roaring.AddOffset(bitmap, base)
+	}
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	if cached, exists := m.Cache[term]; exists {
+		return cached
+	}
+	posting = &MappedPosting{Bitmap: bitmap, Encoded: encoded}
+	m.Cache[term] = posting
+	return posting
+}
+
+func (m *MappedField) Bitmap(term string) *roaring.Bitmap {
+	if posting := m.Posting(term); posting != nil {
+		return posting.Bitmap
+	}
+	return nil
+}
+
+// TermPositions returns the positions of the term within the document, the positions of all the
+// documents of the term are decoded on the first call
+func (m *MappedField) TermPositions(term string, index uint32) []uint32 {
+	posting := m.Posting(term)
+	if posting == nil {
+		return nil
+	}
+	posting.Decoded.Do(func() {
+		positions, err := DecodePositions(posting.Bitmap, posting.Encoded)
+		if err != nil {
+			fmt.Printf("Error decoding the positions of the term %s: %s\n", term, err.Error())
+			positions = map[uint32][]uint32{}
+		}
+		posting.Positions = positions
+	})
+	return posting.Positions[index]
+}
+
+func (m *MappedField) Length(index uint32) (uint32, bool) {
+	if index < m.Base {
+		return 0, false
+	}
+	index -= m.Base
+	idx := sort.Search(len(m.Documents), func(n int) bool { return m.Documents[n] >= index })
+	if idx < len(m.Documents) && m.Documents[idx] == index {
+		return m.Lengths[idx], true
+	}
+	return 0, false
+}
+
+// OpenIndexDump maps the binary index dump instead of loading it into the memory, so the engine can
+// serve the queries as soon as the dictionaries are decoded
+func (i *Indexer) OpenIndexDump(path string) error {
+	t0 := time.Now()
+	defer func(t0 time.Time) {
+		fmt.Printf("Mapping indexes dump took %f seconds\n", time.Since(t0).Seconds())
+	}(t0)
+
+	mapped, err := OpenMappedIndex(path)
+	if err != nil {
+		return err
+	}
+	vocabulary, err := mapped.Vocabulary()
+	if err != nil {
+		_ = mapped.Close()
+		return err
+	}
+	fields := make(map[string]*MappedField, len(Fields))
+	for _, name := range Fields {
+		field, err := mapped.Field(name)
+		if err != nil {
+			_ = mapped.Close()
+			return err
+		}
+		fields[name] = field
+	}
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	for name, field := range fields {
+		i.Fields[name].Map(field)
+	}
+	i.AddWords(vocabulary)
+	i.Modified()
+	i.Mapped = append(i.Mapped, mapped)
+	return nil
+}
+
+// MappedBitmap returns the union of the DefaultFields postings of the term from the in-memory and the mapped fields
+func (i *Indexer) MappedBitmap(term string) *roaring.Bitmap {
+	bitmaps := make([]*roaring.Bitmap, 0, len(DefaultFields))
+	for _, field := range i.SearchFields("") {
+		if bitmap := field.Bitmap(term); bitmap != nil {
+			bitmaps = append(bitmaps, bitmap)
+		}
+	}
+	if len(bitmaps) == 0 {
+		return nil
+	}
+	return roaring.FastOr(bitmaps...)
+}
+
+// Close unmaps the mapped index dumps
+func (i *Indexer) Close() error {
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	var err error
+	for _, mapped := range i.Mapped {
+		if e := mapped.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
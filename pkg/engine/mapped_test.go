@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// OpenTestIndexDump saves the binary dump of the indexer and returns a new indexer mapping the dump
+func OpenTestIndexDump(t *testing.T, indexer *Indexer) *Indexer {
+	directory := t.TempDir()
+	indexPath, dataPath := filepath.Join(directory, "indexes.idx"), filepath.Join(directory, "data.json")
+	if err := indexer.SaveBinaryIndexDump(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.SaveDataDump(dataPath); err != nil {
+		t.Fatal(err)
+	}
+	mapped := NewIndexer()
+	t.Cleanup(func() { _ = mapped.Close() })
+	if err := mapped.OpenIndexDump(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := mapped.LoadDataDump(dataPath); err != nil {
+		t.Fatal(err)
+	}
+	return mapped
+}
+
+func TestMappedIndexSearch(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	mapped := OpenTestIndexDump(t, indexer)
+	for _, query := range append(StorageQueries, "python OR ruby", "abstract:\"living in asia\"", "lang*", "scripting languages") {
+		expected, err := indexer.Search(query, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := mapped.Search(query, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results.NumberOfResults != expected.NumberOfResults || !reflect.DeepEqual(results.Results, expected.Results) {
+			t.Errorf("%s: expected %v, got %v", query, expected.Results, results.Results)
+		}
+	}
+}
+
+func TestMappedIndexModifications(t *testing.T) {
+	mapped := OpenTestIndexDump(t, NewTestIndexer(t, ParserDocuments))
+	if _, err := mapped.DeleteDocument("https://en.wikipedia.org/wiki/Ruby"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mapped.UpdateDocument(WikiXMLDoc{Title: "Perl", Url: "https://en.wikipedia.org/wiki/Perl", Abstract: "perl is a camel"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mapped.AddDocument(WikiXMLDoc{Title: "Rust", Url: "https://en.wikipedia.org/wiki/Rust", Abstract: "rust is a programming language"}); err != nil {
+		t.Fatal(err)
+	}
+	// The postings of the mapped dump are immutable, the modified documents are hidden instead
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"programming language", []string{"Python", "Rust"}},
+		{"ruby", []string{}},
+		{"scripting", []string{}},
+		{"camel", []string{"Perl"}},
+		{"perl", []string{"Perl"}},
+		{"title:rust", []string{"Rust"}},
+	}
+	for _, test := range tests {
+		if titles := MatchedTitles(t, mapped, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+}
+
+func TestMappedField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "indexes.idx")
+	if err := NewTestIndexer(t, ParserDocuments).SaveBinaryIndexDump(path); err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenMappedIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	field, err := index.Field(AbstractField)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lengths leave out the stop words, which keep their positions
+	tests := []struct {
+		base      uint32
+		term      string
+		index     uint32
+		positions []uint32
+		length    uint32
+	}{
+		{0, "python", 0, []uint32{0}, 8},
+		{0, "asia", 2, []uint32{8}, 7},
+		{0, "asia", 4, []uint32{9}, 7},
+		{0, "asia", 0, nil, 8},
+		{0, "missing", 0, nil, 8},
+		{100, "python", 100, []uint32{0}, 8},
+		{100, "python", 0, nil, 0},
+	}
+	for _, test := range tests {
+		if field.Base != test.base {
+			field.Rebase(test.base)
+		}
+		if positions := field.TermPositions(test.term, test.index); !reflect.DeepEqual(positions, test.positions) {
+			t.Errorf("%s@%d+%d: expected the positions %v, got %v", test.term, test.index, test.base, test.positions, positions)
+		}
+		if length, _ := field.Length(test.index); length != test.length {
+			t.Errorf("%d+%d: expected the length %d, got %d", test.index, test.base, test.length, length)
+		}
+	}
+}
+
+func TestOpenIndexDumpErrors(t *testing.T) {
+	directory := t.TempDir()
+	jsonPath := filepath.Join(directory, "indexes.json")
+	if err := NewTestIndexer(t, ParserDocuments).SaveIndexDump(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	emptyPath := filepath.Join(directory, "empty.idx")
+	if err := os.WriteFile(emptyPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		err  error
+	}{
+		{jsonPath, ErrNotBinaryDump},
+		{emptyPath, ErrNotBinaryDump},
+		{filepath.Join(directory, "missing.idx"), os.ErrNotExist},
+	}
+	for _, test := range tests {
+		indexer := NewIndexer()
+		if err := indexer.OpenIndexDump(test.path); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.path, test.err, err)
+		}
+		if len(indexer.Mapped) != 0 {
+			t.Errorf("%s: expected no mapped dump", test.path)
+		}
+	}
+}
+
+func TestCorruptedPostings(t *testing.T) {
+	tests := []struct {
+		field    string
+		query    string
+		expected []string
+	}{
+		{AbstractField, "abstract:python", []string{}},
+		{AbstractField, "title:python", []string{"Python", "Python (snake)"}},
+		{TitleField, "title:python", []string{}},
+		{TitleField, "abstract:python", []string{"Python", "Python (snake)"}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "indexes.idx")
+		if err := NewTestIndexer(t, ParserDocuments).SaveBinaryIndexDump(path); err != nil {
+			t.Fatal(err)
+		}
+		dump, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections, err := ReadSectionTable(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CorruptFile(path, int(sections[PostingsSection+test.field].Offset)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The dictionaries are intact, so the dump is mapped and the postings are verified on their first use
+		indexer := NewIndexer()
+		if err := indexer.OpenIndexDump(path); err != nil {
+			t.Fatal(err)
+		}
+		for index, doc := range ParserDocuments {
+			indexer.Data[uint32(index)] = doc
+		}
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: %s: expected %v, got %v", test.field, test.query, test.expected, titles)
+		}
+		if err := indexer.Fields[test.field].Mapped[0].VerifyPostings(); err == nil {
+			t.Errorf("%s: expected a checksum mismatch", test.field)
+		}
+		_ = indexer.Close()
+	}
+}
+
+func TestConcurrentPostings(t *testing.T) {
+	mapped := OpenTestIndexDump(t, NewTestIndexer(t, ParserDocuments))
+	field := mapped.Fields[AbstractField].Mapped[0]
+	terms := []string{"python", "asia", "snake", "perl", "languag"}
+	postings := make([][]*MappedPosting, 8)
+	var wg sync.WaitGroup
+	for n := range postings {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for _, term := range terms {
+				postings[n] = append(postings[n], field.Posting(term))
+				field.TermPositions(term, 0)
+			}
+		}(n)
+	}
+	wg.Wait()
+	// Every search gets the posting cached first
+	for n := range postings {
+		if !reflect.DeepEqual(postings[n], postings[0]) {
+			t.Fatalf("expected the same postings, got %v and %v", postings[n], postings[0])
+		}
+	}
+	if positions := field.TermPositions("asia", 2); !reflect.DeepEqual(positions, []uint32{8}) {
+		t.Fatalf("unexpected positions %v", positions)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package engine
+
+import (
+	"os"
+	"syscall"
+)
+
+// MapFile maps the file into the memory as read-only and shared, so the processes mapping the same
+// file share the pages through the page cache
+func MapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func UnmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
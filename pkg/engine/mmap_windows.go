@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package engine
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"unsafe"
+)
+
+// MapFile maps the file into the memory as a read-only view
+func MapFile(f *os.File, size int) ([]byte, error) {
+	high, low := uint32(uint64(size)>>32), uint32(uint64(size)&0xffffffff)
+	handle, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, high, low, nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	// The view keeps the mapping alive after its handle is closed
+	defer syscall.CloseHandle(handle)
+
+	address, err := syscall.MapViewOfFile(handle, syscall.FILE_MAP_READ, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	var data []byte
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data, header.Len, header.Cap = address, size, size
+	return data, nil
+}
+
+func UnmapFile(data []byte) error {
+	return os.NewSyscallError("UnmapViewOfFile", syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0]))))
+}
@@ -0,0 +1,375 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	WordToken = iota
+	PhraseToken
+	AndToken
+	OrToken
+	NotToken
+	RequiredToken
+	ProhibitedToken
+	OpenToken
+	CloseToken
+	FieldToken
+	EndToken
+)
+
+// QueryToken is a lexical token of the query language. Start and End are the byte offsets of the
+// token within the query string.
+type QueryToken struct {
+	Kind  int
+	Text  string
+	Slop  int
+	Start int
+	End   int
+}
+
+type ParserInterface interface {
+	Parse(s string) (Query, error)
+}
+
+// QueryParser parses the query language into a Query tree:
+//
+//	or      := and ( "OR" and )*
+//	and     := unary ( ["AND"] unary )*
+//	unary   := ( "NOT" | "-" ) unary | "+" unary | primary
+//	primary := field ":" primary | "(" or ")" | "\"phrase\""[~N] | word
+//
+// Clauses are ANDed unless they are separated by OR, so the + (required) operator is only kept for
+// compatibility with the usual search engine syntax.
+type QueryParser struct {
+	Indexer  *Indexer
+	tokens   []QueryToken
+	position int
+	field    string
+}
+
+func NewQueryParser(indexer *Indexer) *QueryParser {
+	return &QueryParser{
+		Indexer: indexer,
+	}
+}
+
+func isQuerySeparator(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+}
+
+// LexQuery splits the query string into the tokens of the query language
+func LexQuery(s string) []QueryToken {
+	runes := []rune(s)
+	offsets := make([]int, len(runes)+1)
+	offset := 0
+	for idx, r := range runes {
+		offsets[idx] = offset
+		offset += len(string(r))
+	}
+	offsets[len(runes)] = offset
+
+	tokens := make([]QueryToken, 0)
+	for idx := 0; idx < len(runes); {
+		r := runes[idx]
+		switch {
+		case unicode.IsSpace(r):
+			idx++
+		case r == '(':
+			tokens = append(tokens, QueryToken{Kind: OpenToken, Text: "(", Start: offsets[idx], End: offsets[idx+1]})
+			idx++
+		case r == ')':
+			tokens = append(tokens, QueryToken{Kind: CloseToken, Text: ")", Start: offsets[idx], End: offsets[idx+1]})
+			idx++
+		case r == '"':
+			start := idx
+			idx++
+			for idx < len(runes) && runes[idx] != '"' {
+				idx++
+			}
+			text := string(runes[start+1 : idx])
+			if idx < len(runes) {
+				// Skipping the closing quote
+				idx++
+			}
+			slop := 0
+			if idx+1 < len(runes) && runes[idx] == '~' && unicode.IsDigit(runes[idx+1]) {
+				end := idx + 1
+				for end < len(runes) && unicode.IsDigit(runes[end]) {
+					end++
+				}
+				if n, err := strconv.Atoi(string(runes[idx+1 : end])); err == nil {
+					slop = n
+				}
+				idx = end
+			}
+			tokens = append(tokens, QueryToken{Kind: PhraseToken, Text: text, Slop: slop, Start: offsets[start], End: offsets[idx]})
+		case (r == '+' || r == '-') && idx+1 < len(runes) && !unicode.IsSpace(runes[idx+1]):
+			kind := RequiredToken
+			if r == '-' {
+				kind = ProhibitedToken
+			}
+			tokens = append(tokens, QueryToken{Kind: kind, Text: string(r), Start: offsets[idx], End: offsets[idx+1]})
+			idx++
+		default:
+			start := idx
+			for idx < len(runes) && !isQuerySeparator(runes[idx]) {
+				if runes[idx] == ':' && idx+1 < len(runes) && !unicode.IsSpace(runes[idx+1]) && IsField(string(runes[start:idx])) {
+					break
+				}
+				idx++
+			}
+			if idx < len(runes) && runes[idx] == ':' {
+				tokens = append(tokens, QueryToken{Kind: FieldToken, Text: string(runes[start:idx]), Start: offsets[start], End: offsets[idx+1]})
+				idx++
+				continue
+			}
+			text := string(runes[start:idx])
+			kind := WordToken
+			switch text {
+			case "AND", "&&":
+				kind = AndToken
+			case "OR", "||":
+				kind = OrToken
+			case "NOT":
+				kind = NotToken
+			}
+			tokens = append(tokens, QueryToken{Kind: kind, Text: text, Start: offsets[start], End: offsets[idx]})
+		}
+	}
+	return append(tokens, QueryToken{Kind: EndToken, Start: offsets[len(runes)], End: offsets[len(runes)]})
+}
+
+// Parse returns the query tree of the given query string. The returned query is nil if the query
+// does not contain any searchable term (e.g. it only consists of stop words).
+func (p *QueryParser) Parse(s string) (Query, error) {
+	p.tokens = LexQuery(s)
+	p.position = 0
+	p.field = ""
+	query, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.Kind != EndToken {
+		return nil, fmt.Errorf("unexpected %q at offset %d", token.Text, token.Start)
+	}
+	return query, nil
+}
+
+func (p *QueryParser) peek() QueryToken {
+	return p.tokens[p.position]
+}
+
+func (p *QueryParser) next() QueryToken {
+	token := p.tokens[p.position]
+	if token.Kind != EndToken {
+		p.position++
+	}
+	return token
+}
+
+func (p *QueryParser) parseOr() (Query, error) {
+	clauses := make([]Query, 0)
+	for {
+		clause, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if clause != nil {
+			clauses = append(clauses, clause)
+		}
+		if p.peek().Kind != OrToken {
+			break
+		}
+		p.next()
+	}
+	switch len(clauses) {
+	case 0:
+		return nil, nil
+	case 1:
+		return clauses[0], nil
+	default:
+		return &OrQuery{Clauses: clauses}, nil
+	}
+}
+
+func (p *QueryParser) parseAnd() (Query, error) {
+	clauses := make([]Query, 0)
+	for {
+		token := p.peek()
+		if token.Kind == EndToken || token.Kind == CloseToken || token.Kind == OrToken {
+			break
+		}
+		if token.Kind == AndToken {
+			p.next()
+		}
+		clause, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if clause != nil {
+			clauses = append(clauses, clause)
+		}
+	}
+	switch len(clauses) {
+	case 0:
+		return nil, nil
+	case 1:
+		return clauses[0], nil
+	default:
+		return &AndQuery{Clauses: clauses}, nil
+	}
+}
+
+func (p *QueryParser) parseUnary() (Query, error) {
+	switch p.peek().Kind {
+	case NotToken, ProhibitedToken:
+		p.next()
+		clause, err := p.parseUnary()
+		if err != nil || clause == nil {
+			return nil, err
+		}
+		return &NotQuery{Clause: clause}, nil
+	case RequiredToken:
+		p.next()
+		return p.parseUnary()
+	default:
+		return p.parsePrimary()
+	}
+}
+
+func (p *QueryParser) parsePrimary() (Query, error) {
+	token := p.next()
+	switch token.Kind {
+	case FieldToken:
+		// The field scope applies to the following primary, e.g. title:(python OR ruby)
+		previous := p.field
+		p.field = token.Text
+		query, err := p.parsePrimary()
+		p.field = previous
+		return query, err
+	case OpenToken:
+		query, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.Kind != CloseToken {
+			return nil, fmt.Errorf("missing closing parenthesis for the one at offset %d", token.Start)
+		}
+		return query, nil
+	case PhraseToken:
+		return p.phrase(token.Text, token.Slop), nil
+	case WordToken:
+		return p.word(token.Text), nil
+	case EndToken:
+		return nil, fmt.Errorf("unexpected end of the query")
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", token.Text, token.Start)
+	}
+}
+
+func (p *QueryParser) phrase(text string, slop int) Query {
+	tokens := p.Indexer.AnalyzeTokens(text)
+	switch len(tokens) {
+	case 0:
+		return nil
+	case 1:
+		return &TermQuery{Field: p.field, Term: tokens[0].Term}
+	default:
+		return &PhraseQuery{Field: p.field, Phrase: Phrase{Text: text, Slop: slop, Tokens: tokens}}
+	}
+}
+
+// word analyzes a single word of the query. Words which are split into several tokens by the
+// tokenizer (e.g. e-mail) are searched as a phrase.
+func (p *QueryParser) word(text string) Query {
+	if IsWildcard(text) {
+		return p.wildcard(text)
+	}
+	if word, distance, ok := ParseFuzzy(text); ok {
+		return p.fuzzy(word, distance)
+	}
+	if p.Indexer.Fuzziness > 0 {
+		if tokens := p.Indexer.AnalyzeTokens(text); len(tokens) == 1 {
+			return p.fuzzy(text, p.Indexer.Fuzziness)
+		}
+	}
+	return p.phrase(text, 0)
+}
+
+// ParseFuzzy parses the fuzzy syntax word~N where N is the maximum edit distance. A missing distance
+// means the MaxFuzziness.
+func ParseFuzzy(text string) (string, int, bool) {
+	idx := strings.LastIndex(text, "~")
+	if idx <= 0 {
+		return text, 0, false
+	}
+	distance := MaxFuzziness
+	if suffix := text[idx+1:]; suffix != "" {
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 0 {
+			return text, 0, false
+		}
+		distance = MinInt(n, MaxFuzziness)
+	}
+	return text[:idx], distance, true
+}
+
+// fuzzy expands the word to the terms whose surface words are within the edit distance. The exact
+// term gets the weight of 1 and the others are weighted by 1 / (1 + distance), so the exact matches
+// are ranked above the fuzzy ones.
+func (p *QueryParser) fuzzy(text string, distance int) Query {
+	tokens := p.Indexer.AnalyzeTokens(text)
+	if len(tokens) != 1 {
+		return p.phrase(text, 0)
+	}
+	word := tokens[0].Word
+	matches := p.Indexer.FuzzyTree().Search(word, distance)
+	sort.Slice(matches, func(a, b int) bool {
+		if matches[a].Distance != matches[b].Distance {
+			return matches[a].Distance < matches[b].Distance
+		}
+		return matches[a].Word < matches[b].Word
+	})
+
+	query := &FuzzyQuery{Field: p.field, Word: word, Distance: distance}
+	seen := make(map[string]bool)
+	expand := func(stem string, weight float64) {
+		if seen[stem] || p.Indexer.TermBitmap(p.field, stem) == nil {
+			return
+		}
+		seen[stem] = true
+		query.Expansions = append(query.Expansions, stem)
+		query.Weights = append(query.Weights, weight)
+	}
+
+	expand(tokens[0].Term, 1)
+	for _, match := range matches {
+		if len(query.Expansions) >= p.Indexer.MaxExpansions {
+			break
+		}
+		// The matches are sorted by distance, so a stem gets the weight of its closest word
+		if stem, exists := p.Indexer.Vocabulary[match.Word]; exists {
+			expand(stem, 1/float64(1+match.Distance))
+		}
+	}
+	return query
+}
+
+// wildcard expands the pattern over the term dictionary. The pattern is only lowercased since the
+// stemmed form of a prefix is meaningless, e.g. photosynth* matches photosynthesi and photosynthet.
+func (p *QueryParser) wildcard(text string) Query {
+	pattern := strings.ToLower(text)
+	dictionary := p.Indexer.TermDictionary(p.field)
+	var expansions []string
+	if prefix := strings.TrimSuffix(pattern, "*"); !IsWildcard(prefix) {
+		expansions = dictionary.Prefix(prefix, p.Indexer.MaxExpansions)
+	} else {
+		expansions = dictionary.Match(pattern, p.Indexer.MaxExpansions)
+	}
+	return &MultiTermQuery{Field: p.field, Pattern: pattern, Expansions: expansions}
+}
@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ParserDocuments are the documents searched by the query language tests
+var ParserDocuments = []WikiXMLDoc{
+	{Title: "Python", Abstract: "python is a programming language created by guido van rossum"},
+	{Title: "Ruby", Abstract: "ruby is a programming language inspired by perl and smalltalk"},
+	{Title: "Python (snake)", Abstract: "pythons are large snakes living in africa and asia"},
+	{Title: "Perl", Abstract: "perl is a family of scripting languages"},
+	{Title: "Cobra", Abstract: "the king cobra is a venomous snake living in asia"},
+}
+
+func TestLexQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		kinds []int
+		texts []string
+	}{
+		{"python ruby", []int{WordToken, WordToken, EndToken}, []string{"python", "ruby", ""}},
+		{"python OR ruby", []int{WordToken, OrToken, WordToken, EndToken}, []string{"python", "OR", "ruby", ""}},
+		{"python || ruby && perl", []int{WordToken, OrToken, WordToken, AndToken, WordToken, EndToken}, []string{"python", "||", "ruby", "&&", "perl", ""}},
+		{"NOT snake -asia +perl", []int{NotToken, WordToken, ProhibitedToken, WordToken, RequiredToken, WordToken, EndToken}, []string{"NOT", "snake", "-", "asia", "+", "perl", ""}},
+		{"(python)", []int{OpenToken, WordToken, CloseToken, EndToken}, []string{"(", "python", ")", ""}},
+		{`"king cobra"~2 snake`, []int{PhraseToken, WordToken, EndToken}, []string{"king cobra", "snake", ""}},
+		{"title:python", []int{FieldToken, WordToken, EndToken}, []string{"title", "python", ""}},
+		// Only the known fields are field scopes
+		{"python:snake", []int{WordToken, EndToken}, []string{"python:snake", ""}},
+		{"self-hosted - or", []int{WordToken, WordToken, WordToken, EndToken}, []string{"self-hosted", "-", "or", ""}},
+	}
+	for _, test := range tests {
+		tokens := LexQuery(test.query)
+		kinds, texts := make([]int, len(tokens)), make([]string, len(tokens))
+		for idx, token := range tokens {
+			kinds[idx], texts[idx] = token.Kind, token.Text
+			// The offsets of the phrases include the quotes and the ones of the fields include the colon
+			if (token.Kind == WordToken || token.Kind == OrToken) && test.query[token.Start:token.End] != token.Text {
+				t.Errorf("%s: unexpected offsets %d:%d of %q", test.query, token.Start, token.End, token.Text)
+			}
+		}
+		if !reflect.DeepEqual(kinds, test.kinds) || !reflect.DeepEqual(texts, test.texts) {
+			t.Errorf("%s: expected %v %q, got %v %q", test.query, test.kinds, test.texts, kinds, texts)
+		}
+	}
+	if tokens := LexQuery(`"king cobra"~2`); tokens[0].Slop != 2 || tokens[0].End != len(`"king cobra"~2`) {
+		t.Errorf("unexpected phrase token %+v", tokens[0])
+	}
+}
+
+func TestBooleanQueries(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"programming language", []string{"Python", "Ruby"}},
+		{"programming AND language", []string{"Python", "Ruby"}},
+		{"python OR perl", []string{"Perl", "Python", "Python (snake)", "Ruby"}},
+		{"python || cobra", []string{"Cobra", "Python", "Python (snake)"}},
+		{"python NOT snake", []string{"Python"}},
+		{"python -snake", []string{"Python"}},
+		{"+python +snake", []string{"Python (snake)"}},
+		{"asia -(python OR king)", []string{}},
+		{"(python OR ruby) programming", []string{"Python", "Ruby"}},
+		{"snake (asia OR africa) -venomous", []string{"Python (snake)"}},
+		{"NOT NOT python", []string{"Python", "Python (snake)"}},
+		// The empty clauses are ignored
+		{"python OR", []string{"Python", "Python (snake)"}},
+		{"() cobra", []string{"Cobra"}},
+		// AND binds tighter than OR
+		{"perl OR python snake", []string{"Perl", "Python (snake)", "Ruby"}},
+		// The stop words are dropped from the clauses
+		{"the OR cobra", []string{"Cobra"}},
+		{"the", []string{}},
+	}
+	for _, test := range tests {
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+}
+
+func TestProhibitedQueries(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	// The prohibited clauses alone match the live documents, which are kept up to date by the modifications
+	tests := []struct {
+		name     string
+		modify   func() error
+		query    string
+		expected []string
+	}{
+		{"not", nil, "NOT python", []string{"Cobra", "Perl", "Ruby"}},
+		{"prohibited", nil, "-python -snake", []string{"Perl", "Ruby"}},
+		{"deleted", func() error {
+			_, err := indexer.DeleteDocument("https://en.wikipedia.org/wiki/Perl")
+			return err
+		}, "-python", []string{"Cobra", "Ruby"}},
+		{"added", func() error {
+			_, err := indexer.AddDocument(WikiXMLDoc{Title: "Rust", Url: "https://en.wikipedia.org/wiki/Rust", Abstract: "rust is a programming language"})
+			return err
+		}, "NOT python", []string{"Cobra", "Ruby", "Rust"}},
+		{"updated", func() error {
+			_, err := indexer.UpdateDocument(WikiXMLDoc{Title: "Cobra", Url: "https://en.wikipedia.org/wiki/Cobra", Abstract: "cobra eats pythons"})
+			return err
+		}, "-python", []string{"Ruby", "Rust"}},
+	}
+	for _, test := range tests {
+		if test.modify != nil {
+			if err := test.modify(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: %s: expected %v, got %v", test.name, test.query, test.expected, titles)
+		}
+	}
+	if documents := indexer.AllDocuments().GetCardinality(); documents != indexer.NumberOfDocuments() {
+		t.Errorf("expected %d live documents, got %d", indexer.NumberOfDocuments(), documents)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	parser := NewQueryParser(NewIndexer())
+	for _, query := range []string{"(python", "python)", "python (", "title:)", "NOT"} {
+		if _, err := parser.Parse(query); err == nil {
+			t.Errorf("%s: expected a syntax error", query)
+		}
+	}
+}
+
+func TestFieldQueries(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"title:python", []string{"Python", "Python (snake)"}},
+		{"abstract:guido", []string{"Python"}},
+		{"title:guido", []string{}},
+		{"url:snake", []string{"Python (snake)"}},
+		{"title:(python OR perl)", []string{"Perl", "Python", "Python (snake)"}},
+		{"title:python -abstract:snakes", []string{"Python"}},
+		{"perl title:ruby", []string{"Ruby"}},
+		{`abstract:"king cobra"`, []string{"Cobra"}},
+		{`title:"king cobra"`, []string{}},
+		// The scope only applies to the following clause
+		{"title:cobra OR asia", []string{"Cobra", "Python (snake)"}},
+		{"title:(cobra) snake", []string{"Cobra"}},
+		// The unknown fields are searched as words
+		{"language:python", []string{}},
+	}
+	for _, test := range tests {
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+}
+
+func TestUrlPath(t *testing.T) {
+	tests := []struct {
+		url  string
+		path string
+	}{
+		{"https://en.wikipedia.org/wiki/Python_(snake)", "Python_(snake)"},
+		{"https://en.wikipedia.org/wiki/C%2B%2B", "C++"},
+		{"https://en.wikipedia.org/", "/"},
+		{"%zz", ""},
+	}
+	for _, test := range tests {
+		if path := UrlPath(test.url); path != test.path {
+			t.Errorf("%s: expected %q, got %q", test.url, test.path, path)
+		}
+	}
+}
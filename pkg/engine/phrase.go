@@ -0,0 +1,51 @@
+package engine
+
+// Phrase is a quoted part of the query whose tokens should appear adjacently in the document.
+// Slop is the number of positions each token is allowed to drift from its place in the phrase.
+type Phrase struct {
+	Text   string
+	Slop   int
+	Tokens []Token
+}
+
+// MatchPhrase checks whether the analyzed phrase appears within the field of the document. Every token
+// of the phrase should be found at the same distance to the first token as in the phrase, give or take the slop.
+func (f *FieldIndex) MatchPhrase(phrase Phrase, index uint32) bool {
+	if len(phrase.Tokens) == 0 {
+		return true
+	}
+	positions := make([][]uint32, len(phrase.Tokens))
+	for idx, token := range phrase.Tokens {
+		positions[idx] = f.TermPositions(token.Term, index)
+		if len(positions[idx]) == 0 {
+			return false
+		}
+	}
+
+	first := phrase.Tokens[0]
+	for _, start := range positions[0] {
+		matched := true
+		for idx := 1; idx < len(phrase.Tokens) && matched; idx++ {
+			expected := int64(start) + int64(phrase.Tokens[idx].Position) - int64(first.Position)
+			matched = ContainsPosition(positions[idx], expected, phrase.Slop)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsPosition reports whether the ascending positions contain a position within slop of expected
+func ContainsPosition(positions []uint32, expected int64, slop int) bool {
+	for _, position := range positions {
+		distance := int64(position) - expected
+		if distance > int64(slop) {
+			return false
+		}
+		if distance >= -int64(slop) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContainsPosition(t *testing.T) {
+	tests := []struct {
+		positions []uint32
+		expected  int64
+		slop      int
+		contained bool
+	}{
+		{[]uint32{1, 5, 9}, 5, 0, true},
+		{[]uint32{1, 5, 9}, 6, 0, false},
+		{[]uint32{1, 5, 9}, 7, 2, true},
+		{[]uint32{1, 5, 9}, 3, 1, false},
+		{[]uint32{4}, 0, 3, false},
+		{[]uint32{0}, -2, 2, true},
+		{[]uint32{}, 0, 5, false},
+	}
+	for _, test := range tests {
+		if contained := ContainsPosition(test.positions, test.expected, test.slop); contained != test.contained {
+			t.Errorf("%v within %d of %d: expected %v", test.positions, test.slop, test.expected, test.contained)
+		}
+	}
+}
+
+func TestPhraseQueries(t *testing.T) {
+	indexer := NewTestIndexer(t, []WikiXMLDoc{
+		{Title: "Red Panda", Abstract: "the red panda is a small mammal living in the eastern himalayas"},
+		{Title: "Giant Panda", Abstract: "the giant panda is a bear, unlike the red panda it is large"},
+		{Title: "Red Fox", Abstract: "the red fox is the largest of the true foxes, it is red and white"},
+		{Title: "Panda Express", Abstract: "panda express is a restaurant chain, its logo is red"},
+	})
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{`"red panda"`, []string{"Giant Panda", "Red Panda"}},
+		{`"panda red"`, []string{}},
+		{`"red panda is a small mammal"`, []string{"Red Panda"}},
+		// The stop words keep their positions
+		{`"largest of the true foxes"`, []string{"Red Fox"}},
+		{`"largest true"`, []string{}},
+		{`"largest true"~2`, []string{"Red Fox"}},
+		{`"panda small"`, []string{}},
+		{`"panda small"~3`, []string{"Red Panda"}},
+		{`"red white"`, []string{}},
+		{`"red white"~1`, []string{"Red Fox"}},
+		{`title:"red panda"`, []string{"Red Panda"}},
+		{`"red panda" -"giant panda"`, []string{"Red Panda"}},
+		{`"red panda" OR "red fox"`, []string{"Giant Panda", "Red Fox", "Red Panda"}},
+		// A phrase of a single term is a term query
+		{`"restaurant"`, []string{"Panda Express"}},
+	}
+	for _, test := range tests {
+		if titles := MatchedTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// PhraseCheckInterval is the number of the phrase candidates matched between the checks of the context
+const PhraseCheckInterval = 1024
+
+// Query is a node of the parsed query tree. Evaluate returns the matching documents, the returned
+// bitmap might be shared with the indexes so it should not be modified. Terms returns the analyzed
+// terms used for ranking, the terms of the prohibited clauses are not included.
+//
+// The context is checked between the posting list operations. The evaluation stops once the context
+// is done, and the returned documents are then a subset of the matching documents: the remaining
+// clauses of a union are skipped, while a negation which can not be evaluated completely matches
+// nothing.
+type Query interface {
+	Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap
+	Terms() []QueryTerm
+}
+
+// QueryTerm is an analyzed term of the query along with its field scope. An empty field means the
+// term is searched within the DefaultFields. Weight scales the score of the term, the exact terms
+// have a weight of 1 while the fuzzy expansions have lower weights.
+type QueryTerm struct {
+	Field  string
+	Term   string
+	Weight float64
+}
+
+type TermQuery struct {
+	Field string
+	Term  string
+}
+
+type PhraseQuery struct {
+	Field  string
+	Phrase Phrase
+}
+
+// MultiTermQuery matches any of the terms a prefix or a wildcard pattern is expanded to
+type MultiTermQuery struct {
+	Field      string
+	Pattern    string
+	Expansions []string
+}
+
+// FuzzyQuery matches the terms whose surface words are within the edit distance of the word.
+// Weights[n] is the weight of Expansions[n] decreasing with the distance.
+type FuzzyQuery struct {
+	Field      string
+	Word       string
+	Distance   int
+	Expansions []string
+	Weights    []float64
+}
+
+type AndQuery struct {
+	Clauses []Query
+}
+
+type OrQuery struct {
+	Clauses []Query
+}
+
+type NotQuery struct {
+	Clause Query
+}
+
+func (q *TermQuery) Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap {
+	if indexes := i.TermBitmap(q.Field, q.Term); indexes != nil {
+		return indexes
+	}
+	return roaring.NewBitmap()
+}
+
+func (q *TermQuery) Terms() []QueryTerm {
+	return []QueryTerm{{Field: q.Field, Term: q.Term, Weight: 1}}
+}
+
+// Evaluate matches the phrase within every searched field separately, so a phrase does not match
+// across the end of the title and the beginning of the abstract.
+func (q *PhraseQuery) Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap {
+	rb := roaring.NewBitmap()
+	for _, field := range i.SearchFields(q.Field) {
+		if ctx.Err() != nil {
+			break
+		}
+		bitmaps := make([]*roaring.Bitmap, 0, len(q.Phrase.Tokens))
+		for _, token := range q.Phrase.Tokens {
+			if indexes := field.Bitmap(token.Term); indexes != nil {
+				bitmaps = append(bitmaps, indexes)
+			} else {
+				bitmaps = nil
+				break
+			}
+		}
+		if len(bitmaps) == 0 {
+			continue
+		}
+		candidates := roaring.ParAnd(i.Cores, bitmaps...)
+		matched := 0
+		candidates.Iterate(func(index uint32) bool {
+			if field.MatchPhrase(q.Phrase, index) {
+				rb.Add(index)
+			}
+			matched++
+			return matched%PhraseCheckInterval != 0 || ctx.Err() == nil
+		})
+	}
+	return rb
+}
+
+func (q *PhraseQuery) Terms() []QueryTerm {
+	terms := make([]QueryTerm, 0, len(q.Phrase.Tokens))
+	for _, token := range q.Phrase.Tokens {
+		terms = append(terms, QueryTerm{Field: q.Field, Term: token.Term, Weight: 1})
+	}
+	return terms
+}
+
+func (q *MultiTermQuery) Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap {
+	return EvaluateTerms(ctx, i, q.Field, q.Expansions)
+}
+
+func (q *MultiTermQuery) Terms() []QueryTerm {
+	terms := make([]QueryTerm, 0, len(q.Expansions))
+	for _, term := range q.Expansions {
+		terms = append(terms, QueryTerm{Field: q.Field, Term: term, Weight: 1})
+	}
+	return terms
+}
+
+func (q *FuzzyQuery) Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap {
+	return EvaluateTerms(ctx, i, q.Field, q.Expansions)
+}
+
+func (q *FuzzyQuery) Terms() []QueryTerm {
+	terms := make([]QueryTerm, 0, len(q.Expansions))
+	for n, term := range q.Expansions {
+		terms = append(terms, QueryTerm{Field: q.Field, Term: term, Weight: q.Weights[n]})
+	}
+	return terms
+}
+
+// EvaluateTerms returns the union of the documents containing any of the terms, the terms after the
+// context is done are skipped
+func EvaluateTerms(ctx context.Context, i *Indexer, field string, terms []string) *roaring.Bitmap {
+	bitmaps := make([]*roaring.Bitmap, 0, len(terms))
+	for _, term := range terms {
+		if ctx.Err() != nil {
+			break
+		}
+		if indexes := i.TermBitmap(field, term); indexes != nil {
+			bitmaps = append(bitmaps, indexes)
+		}
+	}
+	return roaring.FastOr(bitmaps...)
+}
+
+// Evaluate intersects the clauses and removes the documents matching the prohibited clauses. A query
+// having only prohibited clauses is evaluated against all the documents.
+func (q *AndQuery) Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap {
+	required := make([]*roaring.Bitmap, 0, len(q.Clauses))
+	prohibited := make([]*roaring.Bitmap, 0)
+	for _, clause := range q.Clauses {
+		if not, ok := clause.(*NotQuery); ok {
+			prohibited = append(prohibited, not.Clause.Evaluate(ctx, i))
+		} else {
+			required = append(required, clause.Evaluate(ctx, i))
+		}
+		// The intersection of the partial clauses is a subset of the matches, while the partial
+		// prohibited clauses would remove too few documents
+		if ctx.Err() != nil && len(prohibited) > 0 {
+			return roaring.NewBitmap()
+		}
+	}
+
+	var rb *roaring.Bitmap
+	switch len(required) {
+	case 0:
+		rb = i.AllDocuments().Clone()
+	case 1:
+		rb = required[0].Clone()
+	default:
+		// Parallel ANDing to find the intersection
+		rb = roaring.ParAnd(i.Cores, required...)
+	}
+	if len(prohibited) > 0 {
+		rb.AndNot(roaring.FastOr(prohibited...))
+	}
+	return rb
+}
+
+func (q *AndQuery) Terms() []QueryTerm {
+	terms := make([]QueryTerm, 0)
+	for _, clause := range q.Clauses {
+		terms = append(terms, clause.Terms()...)
+	}
+	return terms
+}
+
+func (q *OrQuery) Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap {
+	bitmaps := make([]*roaring.Bitmap, 0, len(q.Clauses))
+	for _, clause := range q.Clauses {
+		if ctx.Err() != nil {
+			break
+		}
+		bitmaps = append(bitmaps, clause.Evaluate(ctx, i))
+	}
+	return roaring.FastOr(bitmaps...)
+}
+
+func (q *OrQuery) Terms() []QueryTerm {
+	terms := make([]QueryTerm, 0)
+	for _, clause := range q.Clauses {
+		terms = append(terms, clause.Terms()...)
+	}
+	return terms
+}
+
+func (q *NotQuery) Evaluate(ctx context.Context, i *Indexer) *roaring.Bitmap {
+	excluded := q.Clause.Evaluate(ctx, i)
+	if ctx.Err() != nil {
+		return roaring.NewBitmap()
+	}
+	return roaring.AndNot(i.AllDocuments(), excluded)
+}
+
+func (q *NotQuery) Terms() []QueryTerm {
+	return nil
+}
@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"math"
+)
+
+const (
+	DefaultK1 = 1.2
+	DefaultB  = 0.75
+)
+
+type RankerInterface interface {
+	IDF(df uint64, docs uint64) float64
+	Score(tf uint32, idf float64, length uint32, avgLength float64) float64
+}
+
+// BM25 implements the Okapi BM25 ranking function. K1 controls the term frequency saturation
+// and B controls how much the document length normalizes the term frequency.
+type BM25 struct {
+	K1 float64
+	B  float64
+}
+
+func NewBM25(k1 float64, b float64) *BM25 {
+	return &BM25{
+		K1: k1,
+		B:  b,
+	}
+}
+
+func (r *BM25) IDF(df uint64, docs uint64) float64 {
+	return math.Log(1 + (float64(docs)-float64(df)+0.5)/(float64(df)+0.5))
+}
+
+func (r *BM25) Score(tf uint32, idf float64, length uint32, avgLength float64) float64 {
+	if tf == 0 {
+		return 0
+	}
+	frequency := float64(tf)
+	norm := 1 - r.B
+	if avgLength > 0 {
+		norm += r.B * float64(length) / avgLength
+	}
+	return idf * (frequency * (r.K1 + 1)) / (frequency + r.K1*norm)
+}
+
+type termWeight struct {
+	field     *FieldIndex
+	term      string
+	weight    float64
+	idf       float64
+	avgLength float64
+}
+
+// Scorer ranks the documents for the terms of a query. The inverse document frequencies and the
+// average field lengths are computed once per query, the score of a document is the sum of the
+// BM25 scores of the terms within every searched field multiplied by the boost of the field and the
+// weight of the term.
+type Scorer struct {
+	Ranker  *BM25
+	weights []termWeight
+}
+
+func (i *Indexer) NewScorer(terms []QueryTerm) *Scorer {
+	docs := i.NumberOfDocuments()
+	weights := make([]termWeight, 0, len(terms))
+	for _, term := range terms {
+		for _, field := range i.SearchFields(term.Field) {
+			indexes := field.Bitmap(term.Term)
+			if indexes == nil || docs == 0 {
+				continue
+			}
+			weights = append(weights, termWeight{
+				field:     field,
+				term:      term.Term,
+				weight:    term.Weight,
+				idf:       i.Ranker.IDF(indexes.GetCardinality(), docs),
+				avgLength: float64(field.TotalLength) / float64(docs),
+			})
+		}
+	}
+	return &Scorer{
+		Ranker:  i.Ranker,
+		weights: weights,
+	}
+}
+
+func (s *Scorer) Score(index uint32) float64 {
+	score := 0.0
+	for _, weight := range s.weights {
+		tf := uint32(len(weight.field.TermPositions(weight.term, index)))
+		if tf == 0 {
+			continue
+		}
+		score += weight.weight * weight.field.Boost * s.Ranker.Score(tf, weight.idf, weight.field.Length(index), weight.avgLength)
+	}
+	return score
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBM25(t *testing.T) {
+	ranker := NewBM25(DefaultK1, DefaultB)
+	tests := []struct {
+		name     string
+		score    float64
+		expected float64
+	}{
+		{"idf of a rare term", ranker.IDF(1, 10), math.Log(1 + 9.5/1.5)},
+		{"idf of a term in every document", ranker.IDF(10, 10), math.Log(1 + 0.5/10.5)},
+		{"missing term", ranker.Score(0, 2, 10, 10), 0},
+		{"single occurrence in a document of the average length", ranker.Score(1, 2, 10, 10), 2},
+		{"document twice the average length", ranker.Score(1, 1, 20, 10), 2.2 / (1 + 1.2*1.75)},
+		{"no length normalization", NewBM25(DefaultK1, 0).Score(1, 1, 20, 10), 1},
+		{"no documents", ranker.Score(1, 1, 5, 0), 2.2 / (1 + 1.2*0.25)},
+	}
+	for _, test := range tests {
+		if math.Abs(test.score-test.expected) > 1e-9 {
+			t.Errorf("%s: expected %f, got %f", test.name, test.expected, test.score)
+		}
+	}
+
+	comparisons := []struct {
+		name   string
+		higher float64
+		lower  float64
+	}{
+		{"rare terms", ranker.IDF(1, 100), ranker.IDF(50, 100)},
+		{"frequent terms within the document", ranker.Score(3, 1, 10, 10), ranker.Score(1, 1, 10, 10)},
+		{"saturated term frequency", 3 * ranker.Score(1, 1, 10, 10), ranker.Score(3, 1, 10, 10)},
+		{"upper bound of the term frequency", 1 + DefaultK1, ranker.Score(1000, 1, 10, 10)},
+		{"short documents", ranker.Score(1, 1, 5, 10), ranker.Score(1, 1, 20, 10)},
+	}
+	for _, comparison := range comparisons {
+		if comparison.higher <= comparison.lower {
+			t.Errorf("%s: expected %f to be higher than %f", comparison.name, comparison.higher, comparison.lower)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	indexer := NewTestIndexer(t, []WikiXMLDoc{
+		{Title: "Alpha", Abstract: "alpha is the first letter of the greek alphabet"},
+		{Title: "Greek alphabet", Abstract: "the letters are alpha beta gamma delta epsilon zeta eta theta iota kappa lambda"},
+		{Title: "Beta", Abstract: "beta is the second letter and follows alpha, beta is written as b"},
+		{Title: "Gamma", Abstract: "gamma is the third letter"},
+	})
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		// The title hits outrank the abstract hits
+		{"alpha", []string{"Alpha", "Beta", "Greek alphabet"}},
+		// The repeated term outranks the single occurrence in a longer abstract
+		{"beta", []string{"Beta", "Greek alphabet"}},
+		// The rare term outweighs the common one
+		{"gamma OR letter", []string{"Gamma", "Greek alphabet", "Alpha", "Beta"}},
+		{"omega", []string{}},
+	}
+	for _, test := range tests {
+		if titles := SearchTitles(t, indexer, test.query); !reflect.DeepEqual(titles, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, titles)
+		}
+	}
+}
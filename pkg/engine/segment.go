@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+type SegmentInterface interface {
+	AddIndex(field string, tokens []Token, index uint32)
+}
+
+// Segment is the private index of an indexing worker. The workers add the documents into their own
+// segments without locking, and the segments are merged into the indexer once all the documents
+// are indexed. The documents of the segments are disjoint, so only the bitmaps have to be merged.
+type Segment struct {
+	Fields     map[string]*FieldIndex
+	Vocabulary map[string]string
+}
+
+func NewSegment() *Segment {
+	return &Segment{
+		Fields:     NewFieldIndexes(),
+		Vocabulary: map[string]string{},
+	}
+}
+
+func (s *Segment) AddIndex(field string, tokens []Token, index uint32) {
+	positions := make(map[string][]uint32, len(tokens))
+	for idx := range tokens {
+		token := tokens[idx]
+		positions[token.Term] = append(positions[token.Term], token.Position)
+		s.Vocabulary[token.Word] = token.Term
+	}
+	fieldIndex := s.Fields[field]
+	fieldIndex.Lengths[index] = uint32(len(tokens))
+	fieldIndex.TotalLength += uint64(len(tokens))
+
+	for token, position := range positions {
+		if indexes, exists := fieldIndex.Indexes[token]; exists {
+			indexes.Add(index)
+		} else {
+			fieldIndex.Indexes[token] = roaring.BitmapOf(index)
+			fieldIndex.Positions[token] = map[uint32][]uint32{}
+		}
+		fieldIndex.Positions[token][index] = position
+	}
+}
+
+// MergeSegments merges the postings of the segments into the indexes, the bitmaps of a term are
+// merged with roaring.ParOr
+func (i *Indexer) MergeSegments(segments []*Segment) {
+	t0 := time.Now()
+	defer func(t0 time.Time) {
+		fmt.Printf("Merging %d segments took %f seconds\n", len(segments), time.Since(t0).Seconds())
+	}(t0)
+
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	defaults := map[string]bool{}
+	for _, name := range Fields {
+		fieldIndex := i.Fields[name]
+		postings := map[string][]*roaring.Bitmap{}
+		for _, segment := range segments {
+			field := segment.Fields[name]
+			for term, indexes := range field.Indexes {
+				postings[term] = append(postings[term], indexes)
+			}
+			for index, length := range field.Lengths {
+				fieldIndex.Lengths[index] = length
+			}
+			fieldIndex.TotalLength += field.TotalLength
+		}
+
+		for term, bitmaps := range postings {
+			if indexes, exists := fieldIndex.Indexes[term]; exists {
+				bitmaps = append(bitmaps, indexes)
+			} else {
+				fieldIndex.Positions[term] = map[uint32][]uint32{}
+			}
+			if len(bitmaps) == 1 {
+				// The bitmap of a single segment is not shared, so it is not cloned
+				fieldIndex.Indexes[term] = bitmaps[0]
+			} else {
+				fieldIndex.Indexes[term] = roaring.ParOr(i.Cores, bitmaps...)
+			}
+			for _, segment := range segments {
+				for index, positions := range segment.Fields[name].Positions[term] {
+					fieldIndex.Positions[term][index] = positions
+				}
+			}
+			if IsDefaultField(name) {
+				defaults[term] = true
+			}
+		}
+	}
+
+	// The union of the DefaultFields is rebuilt for the modified terms, the in-memory field postings
+	// contain the previous documents of the terms as well
+	for term := range defaults {
+		bitmaps := make([]*roaring.Bitmap, 0, len(DefaultFields))
+		for _, field := range i.SearchFields("") {
+			if indexes, exists := field.Indexes[term]; exists {
+				bitmaps = append(bitmaps, indexes)
+			}
+		}
+		i.Indexes[term] = roaring.ParOr(i.Cores, bitmaps...)
+	}
+
+	for _, segment := range segments {
+		i.AddWords(segment.Vocabulary)
+	}
+	i.Modified()
+}
@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const SnapshotVersion = 1
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+type SnapshotInterface interface {
+	Verify(indexer *Indexer) error
+	Contains(paths ...string) bool
+}
+
+// SnapshotFile is a file of the snapshot with its CRC-32C checksum, the name is relative to the manifest
+type SnapshotFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// SnapshotManifest describes the index and the data dumps saved together, so a truncated or a stale
+// dump is detected before it is loaded. Documents and Terms are the counts of the saved indexer.
+type SnapshotManifest struct {
+	Version   int            `json:"version"`
+	Created   time.Time      `json:"created"`
+	Documents uint64         `json:"documents"`
+	Terms     uint64         `json:"terms"`
+	Files     []SnapshotFile `json:"files"`
+}
+
+// WriteFileAtomic writes the file into a temporary file, which is synced and renamed over the path, so
+// a crash leaves either the previous or the new file in place
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	temporary := path + TemporarySuffix
+	f, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(f, XmlStreamBufferSize)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(temporary, path)
+	}
+	if err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+	return SyncDirectory(filepath.Dir(path))
+}
+
+// SyncDirectory syncs the directory, so the renamed files survive a crash
+func SyncDirectory(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// FileChecksum returns the size and the CRC-32C checksum of the file
+func FileChecksum(path string) (int64, uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func(f *os.File) {
+		if err := f.Close(); err != nil {
+			fmt.Printf("Error closing %s: %s\n", path, err.Error())
+		}
+	}(f)
+	hash := crc32.New(CastagnoliTable)
+	size, err := io.Copy(hash, bufio.NewReaderSize(f, XmlStreamBufferSize))
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, hash.Sum32(), nil
+}
+
+// NumberOfTerms returns the number of the terms summed over the fields
+func (i *Indexer) NumberOfTerms() uint64 {
+	terms := uint64(0)
+	for _, field := range i.Fields {
+		terms += uint64(field.Len())
+	}
+	return terms
+}
+
+// SaveSnapshotManifest writes the manifest of the saved dumps, the dumps must be written before
+func (i *Indexer) SaveSnapshotManifest(path string, files ...string) error {
+	i.SearchMutex.RLock()
+	manifest := SnapshotManifest{
+		Version:   SnapshotVersion,
+		Created:   time.Now().UTC(),
+		Documents: i.NumberOfDocuments(),
+		Terms:     i.NumberOfTerms(),
+		Files:     make([]SnapshotFile, 0, len(files)),
+	}
+	i.SearchMutex.RUnlock()
+	for _, file := range files {
+		size, checksum, err := FileChecksum(file)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, SnapshotFile{Name: filepath.Base(file), Size: size, Checksum: checksum})
+	}
+	b, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// LoadSnapshotManifest reads the manifest and verifies the sizes and the checksums of its files. The
+// checksum of a binary index dump is not verified, since its sections have their own checksums which
+// are verified when they are decoded, so mapping a large dump does not read the whole file.
+func LoadSnapshotManifest(path string) (*SnapshotManifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	manifest := &SnapshotManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSnapshot, path, err.Error())
+	}
+	if manifest.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: %s has version %d", ErrInvalidSnapshot, path, manifest.Version)
+	}
+	for _, file := range manifest.Files {
+		if err := file.Verify(filepath.Join(filepath.Dir(path), file.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// Verify compares the size of the file with the manifest, and the checksum as well unless the file is
+// a binary index dump
+func (f SnapshotFile) Verify(path string) error {
+	isBinary, err := IsBinaryIndexDump(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	if isBinary {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+		}
+		if info.Size() != f.Size {
+			return fmt.Errorf("%w: %s size mismatch", ErrInvalidSnapshot, f.Name)
+		}
+		return nil
+	}
+	size, checksum, err := FileChecksum(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	if size != f.Size || checksum != f.Checksum {
+		return fmt.Errorf("%w: %s checksum mismatch", ErrInvalidSnapshot, f.Name)
+	}
+	return nil
+}
+
+// Contains reports whether the files are parts of the snapshot
+func (m *SnapshotManifest) Contains(paths ...string) bool {
+	for _, path := range paths {
+		found := false
+		for _, file := range m.Files {
+			if file.Name == filepath.Base(path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify compares the counts of the indexer loaded from the snapshot with the counts of the manifest
+func (m *SnapshotManifest) Verify(indexer *Indexer) error {
+	indexer.SearchMutex.RLock()
+	defer indexer.SearchMutex.RUnlock()
+	if documents := indexer.NumberOfDocuments(); documents != m.Documents {
+		return fmt.Errorf("%w: expected %d documents, loaded %d", ErrInvalidSnapshot, m.Documents, documents)
+	}
+	if terms := indexer.NumberOfTerms(); terms != m.Terms {
+		return fmt.Errorf("%w: expected %d terms, loaded %d", ErrInvalidSnapshot, m.Terms, terms)
+	}
+	return nil
+}
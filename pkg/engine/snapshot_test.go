@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSnapshotManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		index   string
+		corrupt func(indexPath string, dataPath string) error
+		invalid bool
+	}{
+		{"binary", "indexes.idx", nil, false},
+		{"json", "indexes.json", nil, false},
+		{"truncated binary", "indexes.idx", func(indexPath string, dataPath string) error {
+			return os.Truncate(indexPath, IndexHeaderSize)
+		}, true},
+		{"corrupted json", "indexes.json", func(indexPath string, dataPath string) error {
+			return CorruptFile(indexPath, 1)
+		}, true},
+		{"corrupted data", "indexes.idx", func(indexPath string, dataPath string) error {
+			return CorruptFile(dataPath, 1)
+		}, true},
+		// The sections of the binary dump are verified by their own checksums when they are decoded
+		{"corrupted binary", "indexes.idx", func(indexPath string, dataPath string) error {
+			return CorruptFile(indexPath, -1)
+		}, false},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		indexer := NewTestIndexer(t, ParserDocuments)
+		indexPath, dataPath, manifestPath := filepath.Join(directory, test.index), filepath.Join(directory, "data.json"), filepath.Join(directory, "snapshot.json")
+		if err := indexer.SaveIndexDump(indexPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := indexer.SaveDataDump(dataPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := indexer.SaveSnapshotManifest(manifestPath, indexPath, dataPath); err != nil {
+			t.Fatal(err)
+		}
+		if test.corrupt != nil {
+			if err := test.corrupt(indexPath, dataPath); err != nil {
+				t.Fatal(err)
+			}
+		}
+		manifest, err := LoadSnapshotManifest(manifestPath)
+		if invalid := errors.Is(err, ErrInvalidSnapshot); invalid != test.invalid {
+			t.Errorf("%s: expected an invalid snapshot %t, got %v", test.name, test.invalid, err)
+		}
+		if err == nil && !manifest.Contains(indexPath, dataPath) {
+			t.Errorf("%s: expected the manifest to contain the dumps", test.name)
+		}
+	}
+}
+
+// CorruptFile increments the byte at the offset, a negative offset is relative to the end of the file
+func CorruptFile(path string, offset int) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		offset += len(b)
+	}
+	b[offset]++
+	return os.WriteFile(path, b, 0644)
+}
@@ -4,6 +4,7 @@ import "github.com/kljensen/snowball"
 
 type StemmerInterface interface {
 	Stem(tokens []string) []string
+	StemToken(token string) (string, error)
 }
 
 type Stemmer struct {}
@@ -16,9 +17,13 @@ func (s *Stemmer) Stem(tokens []string) []string {
 	newTokens := make([]string, 0, len(tokens))
 	for idx := range tokens {
 		token := tokens[idx]
-		if stemmed, err := snowball.Stem(token, "english", false); err == nil {
+		if stemmed, err := s.StemToken(token); err == nil {
 			newTokens = append(newTokens, stemmed)
 		}
 	}
 	return newTokens
 }
+
+func (s *Stemmer) StemToken(token string) (string, error) {
+	return snowball.Stem(token, "english", false)
+}
@@ -0,0 +1,489 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// The binary index dump has the following layout (fixed size integers are little endian):
+//
+//	header    magic "WSIX" | version uint16 | reserved uint16 | table length uint32 | table checksum uint32
+//	table     uvarint count | count * (name | offset uvarint | length uvarint | checksum uint32)
+//	sections  the sections referenced by the table
+//
+// The sections are the vocabulary, and the lengths, dictionary and postings of every field. The
+// dictionary has the sorted terms of the field along with the offset and the length of their postings,
+// and a posting is the roaring native serialization of the documents followed by the delta encoded
+// positions of the term within every document. Strings are encoded as uvarint length | bytes.
+const (
+	IndexMagic        = "WSIX"
+	IndexVersion      = uint16(1)
+	IndexHeaderSize   = 16
+	VocabularySection = "vocabulary"
+	LengthsSection    = "lengths/"
+	DictionarySection = "dictionary/"
+	PostingsSection   = "postings/"
+	JSONExtension     = ".json"
+)
+
+var (
+	CastagnoliTable  = crc32.MakeTable(crc32.Castagnoli)
+	ErrNotBinaryDump = errors.New("not a binary index dump")
+)
+
+type Section struct {
+	Name     string
+	Offset   uint64
+	Length   uint64
+	Checksum uint32
+}
+
+// DictionaryEntry locates the postings of a term within the postings section of its field
+type DictionaryEntry struct {
+	Term   string
+	Offset uint64
+	Length uint64
+}
+
+type sectionWriter struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *sectionWriter) PutUvarint(x uint64) {
+	n := binary.PutUvarint(w.scratch[:], x)
+	w.Write(w.scratch[:n])
+}
+
+func (w *sectionWriter) PutString(s string) {
+	w.PutUvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+// SectionReader decodes the values of a section, the first decoding error is kept in Err
+type SectionReader struct {
+	Buffer []byte
+	Offset int
+	Err    error
+}
+
+func (r *SectionReader) Uvarint() uint64 {
+	if r.Err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.Buffer[r.Offset:])
+	if n <= 0 {
+		r.Err = io.ErrUnexpectedEOF
+		return 0
+	}
+	r.Offset += n
+	return x
+}
+
+func (r *SectionReader) Bytes(n uint64) []byte {
+	if r.Err != nil {
+		return nil
+	}
+	if n > uint64(len(r.Buffer)-r.Offset) {
+		r.Err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.Buffer[r.Offset : r.Offset+int(n)]
+	r.Offset += int(n)
+	return b
+}
+
+func (r *SectionReader) String() string {
+	return string(r.Bytes(r.Uvarint()))
+}
+
+func (r *SectionReader) Uint32() uint32 {
+	if b := r.Bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// IsBinaryIndexDump checks the magic bytes of the file
+func IsBinaryIndexDump(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func(f *os.File) {
+		if err := f.Close(); err != nil {
+			fmt.Printf("Error closing index file: %s\n", err.Error())
+		}
+	}(f)
+
+	magic := make([]byte, len(IndexMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		// Files shorter than the magic bytes can not be binary dumps
+		return false, nil
+	}
+	return string(magic) == IndexMagic, nil
+}
+
+// ReadSectionTable validates the header of the binary dump and returns its sections
+func ReadSectionTable(buffer []byte) (map[string]Section, error) {
+	if len(buffer) < IndexHeaderSize || string(buffer[:4]) != IndexMagic {
+		return nil, ErrNotBinaryDump
+	}
+	if version := binary.LittleEndian.Uint16(buffer[4:6]); version != IndexVersion {
+		return nil, fmt.Errorf("unsupported index dump version %d", version)
+	}
+	tableLength := uint64(binary.LittleEndian.Uint32(buffer[8:12]))
+	if tableLength > uint64(len(buffer)-IndexHeaderSize) {
+		return nil, fmt.Errorf("index dump is truncated")
+	}
+	table := buffer[IndexHeaderSize : IndexHeaderSize+tableLength]
+	if crc32.Checksum(table, CastagnoliTable) != binary.LittleEndian.Uint32(buffer[12:16]) {
+		return nil, fmt.Errorf("index dump section table checksum mismatch")
+	}
+
+	reader := &SectionReader{Buffer: table}
+	count := reader.Uvarint()
+	sections := make(map[string]Section, count)
+	for n := uint64(0); n < count && reader.Err == nil; n++ {
+		section := Section{
+			Name:   reader.String(),
+			Offset: reader.Uvarint(),
+			Length: reader.Uvarint(),
+		}
+		section.Checksum = reader.Uint32()
+		if section.Offset+section.Length > uint64(len(buffer)) {
+			return nil, fmt.Errorf("index dump section %s is truncated", section.Name)
+		}
+		sections[section.Name] = section
+	}
+	if reader.Err != nil {
+		return nil, reader.Err
+	}
+	return sections, nil
+}
+
+// SectionBytes returns the bytes of the section after verifying its checksum
+func SectionBytes(buffer []byte, sections map[string]Section, name string) ([]byte, error) {
+	section, exists := sections[name]
+	if !exists {
+		return nil, fmt.Errorf("index dump has no section %s", name)
+	}
+	b := buffer[section.Offset : section.Offset+section.Length]
+	if crc32.Checksum(b, CastagnoliTable) != section.Checksum {
+		return nil, fmt.Errorf("index dump section %s checksum mismatch", name)
+	}
+	return b, nil
+}
+
+func (i *Indexer) SaveBinaryIndexDump(path string) error {
+	i.SearchMutex.RLock()
+	defer i.SearchMutex.RUnlock()
+	names, sections, err := i.IndexSections()
+	if err != nil {
+		return err
+	}
+	return WriteSections(path, names, sections)
+}
+
+// IndexSections encodes the vocabulary and the fields into the sections of the binary index dump
+func (i *Indexer) IndexSections() ([]string, map[string]*sectionWriter, error) {
+	names := make([]string, 0, 1+3*len(Fields))
+	sections := make(map[string]*sectionWriter, 1+3*len(Fields))
+
+	vocabulary := &sectionWriter{}
+	words := make([]string, 0, len(i.Vocabulary))
+	for word := range i.Vocabulary {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	vocabulary.PutUvarint(uint64(len(words)))
+	for _, word := range words {
+		vocabulary.PutString(word)
+		vocabulary.PutString(i.Vocabulary[word])
+	}
+	names = append(names, VocabularySection)
+	sections[VocabularySection] = vocabulary
+
+	for _, name := range Fields {
+		field := i.Fields[name]
+
+		lengths := &sectionWriter{}
+		documentLengths := field.DocumentLengths()
+		indexes := make([]uint32, 0, len(documentLengths))
+		for index := range documentLengths {
+			indexes = append(indexes, index)
+		}
+		sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+		lengths.PutUvarint(uint64(len(indexes)))
+		previous := uint32(0)
+		for _, index := range indexes {
+			lengths.PutUvarint(uint64(index - previous))
+			lengths.PutUvarint(uint64(documentLengths[index]))
+			previous = index
+		}
+
+		dictionary, postings := &sectionWriter{}, &sectionWriter{}
+		terms := field.Terms()
+		sort.Strings(terms)
+		dictionary.PutUvarint(uint64(len(terms)))
+		for _, term := range terms {
+			offset := postings.Len()
+			if err := field.EncodePosting(postings, term); err != nil {
+				return nil, nil, err
+			}
+			dictionary.PutString(term)
+			dictionary.PutUvarint(uint64(offset))
+			dictionary.PutUvarint(uint64(postings.Len() - offset))
+		}
+
+		names = append(names, LengthsSection+name, DictionarySection+name, PostingsSection+name)
+		sections[LengthsSection+name] = lengths
+		sections[DictionarySection+name] = dictionary
+		sections[PostingsSection+name] = postings
+	}
+	return names, sections, nil
+}
+
+// EncodePosting writes the documents and the positions of the term into the section
+func (f *FieldIndex) EncodePosting(w *sectionWriter, term string) error {
+	bitmap := f.Bitmap(term)
+	serialized, err := bitmap.ToBytes()
+	if err != nil {
+		return err
+	}
+	w.PutUvarint(uint64(len(serialized)))
+	w.Write(serialized)
+	iterator := bitmap.Iterator()
+	for iterator.HasNext() {
+		positions := f.TermPositions(term, iterator.Next())
+		w.PutUvarint(uint64(len(positions)))
+		previous := uint32(0)
+		for _, position := range positions {
+			w.PutUvarint(uint64(position - previous))
+			previous = position
+		}
+	}
+	return nil
+}
+
+// DecodePosting reads the documents and the positions of a term encoded by EncodePosting
+func DecodePosting(b []byte) (*roaring.Bitmap, map[uint32][]uint32, error) {
+	serialized, encoded, err := SplitPosting(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	bitmap := roaring.NewBitmap()
+	if err := bitmap.UnmarshalBinary(serialized); err != nil {
+		return nil, nil, err
+	}
+	positions, err := DecodePositions(bitmap, encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bitmap, positions, nil
+}
+
+// SplitPosting returns the serialized bitmap and the encoded positions of a posting
+func SplitPosting(b []byte) ([]byte, []byte, error) {
+	reader := &SectionReader{Buffer: b}
+	serialized := reader.Bytes(reader.Uvarint())
+	if reader.Err != nil {
+		return nil, nil, reader.Err
+	}
+	return serialized, b[reader.Offset:], nil
+}
+
+// DecodePositions reads the positions of the term within every document of the bitmap
+func DecodePositions(bitmap *roaring.Bitmap, b []byte) (map[uint32][]uint32, error) {
+	reader := &SectionReader{Buffer: b}
+	positions := make(map[uint32][]uint32, bitmap.GetCardinality())
+	iterator := bitmap.Iterator()
+	for iterator.HasNext() && reader.Err == nil {
+		index := iterator.Next()
+		count := reader.Uvarint()
+		if count > uint64(len(b)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		documentPositions := make([]uint32, count)
+		previous := uint32(0)
+		for n := range documentPositions {
+			previous += uint32(reader.Uvarint())
+			documentPositions[n] = previous
+		}
+		positions[index] = documentPositions
+	}
+	return positions, reader.Err
+}
+
+// DecodeDictionary reads the sorted entries of a dictionary section
+func DecodeDictionary(b []byte) ([]DictionaryEntry, error) {
+	reader := &SectionReader{Buffer: b}
+	count := reader.Uvarint()
+	if count > uint64(len(b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	entries := make([]DictionaryEntry, 0, count)
+	for n := uint64(0); n < count && reader.Err == nil; n++ {
+		entries = append(entries, DictionaryEntry{
+			Term:   reader.String(),
+			Offset: reader.Uvarint(),
+			Length: reader.Uvarint(),
+		})
+	}
+	return entries, reader.Err
+}
+
+// DecodeLengths reads the sorted documents of the field with their lengths, and returns them with the
+// total length of the field
+func DecodeLengths(b []byte) ([]uint32, []uint32, uint64, error) {
+	reader := &SectionReader{Buffer: b}
+	count := reader.Uvarint()
+	if count > uint64(len(b)) {
+		return nil, nil, 0, io.ErrUnexpectedEOF
+	}
+	documents := make([]uint32, 0, count)
+	lengths := make([]uint32, 0, count)
+	total := uint64(0)
+	index := uint32(0)
+	for n := uint64(0); n < count && reader.Err == nil; n++ {
+		index += uint32(reader.Uvarint())
+		length := reader.Uvarint()
+		documents = append(documents, index)
+		lengths = append(lengths, uint32(length))
+		total += length
+	}
+	return documents, lengths, total, reader.Err
+}
+
+func DecodeVocabulary(b []byte) (map[string]string, error) {
+	reader := &SectionReader{Buffer: b}
+	count := reader.Uvarint()
+	if count > uint64(len(b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	vocabulary := make(map[string]string, count)
+	for n := uint64(0); n < count && reader.Err == nil; n++ {
+		word := reader.String()
+		vocabulary[word] = reader.String()
+	}
+	return vocabulary, reader.Err
+}
+
+// WriteSections writes the header, the section table and the sections in the given order atomically
+func WriteSections(path string, names []string, sections map[string]*sectionWriter) error {
+	// The offsets of the sections depend on the length of the table which in turn depends on the
+	// varint lengths of the offsets, so the table is rewritten until its length is stable.
+	table := &sectionWriter{}
+	offset := uint64(0)
+	for {
+		table.Reset()
+		table.PutUvarint(uint64(len(names)))
+		current := uint64(IndexHeaderSize) + offset
+		for _, name := range names {
+			section := sections[name]
+			table.PutString(name)
+			table.PutUvarint(current)
+			table.PutUvarint(uint64(section.Len()))
+			checksum := make([]byte, 4)
+			binary.LittleEndian.PutUint32(checksum, crc32.Checksum(section.Bytes(), CastagnoliTable))
+			table.Write(checksum)
+			current += uint64(section.Len())
+		}
+		if uint64(table.Len()) == offset {
+			break
+		}
+		offset = uint64(table.Len())
+	}
+
+	header := make([]byte, IndexHeaderSize)
+	copy(header, IndexMagic)
+	binary.LittleEndian.PutUint16(header[4:6], IndexVersion)
+	binary.LittleEndian.PutUint32(header[8:12], uint32(table.Len()))
+	binary.LittleEndian.PutUint32(header[12:16], crc32.Checksum(table.Bytes(), CastagnoliTable))
+
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(table.Bytes()); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := w.Write(sections[name].Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (i *Indexer) LoadBinaryIndexDump(path string) error {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sections, err := ReadSectionTable(buffer)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	b, err := SectionBytes(buffer, sections, VocabularySection)
+	if err != nil {
+		return err
+	}
+	if i.Vocabulary, err = DecodeVocabulary(b); err != nil {
+		return err
+	}
+	i.BKTree, i.PendingWords = nil, nil
+	i.Modified()
+
+	for _, name := range Fields {
+		field := i.Fields[name]
+		if b, err = SectionBytes(buffer, sections, LengthsSection+name); err != nil {
+			return err
+		}
+		documents, lengths, total, err := DecodeLengths(b)
+		if err != nil {
+			return err
+		}
+		for n, index := range documents {
+			field.Lengths[index] = lengths[n]
+		}
+		field.TotalLength = total
+
+		if b, err = SectionBytes(buffer, sections, DictionarySection+name); err != nil {
+			return err
+		}
+		entries, err := DecodeDictionary(b)
+		if err != nil {
+			return err
+		}
+		postings, err := SectionBytes(buffer, sections, PostingsSection+name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Offset+entry.Length > uint64(len(postings)) {
+				return fmt.Errorf("index dump %s is corrupted for token %s of the field %s", path, entry.Term, name)
+			}
+			bitmap, positions, err := DecodePosting(postings[entry.Offset : entry.Offset+entry.Length])
+			if err != nil {
+				return err
+			}
+			field.Indexes[entry.Term] = bitmap
+			field.Positions[entry.Term] = positions
+		}
+	}
+	i.BuildDefaultIndexes()
+	return nil
+}
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// StorageQueries are compared between the saved and the loaded indexes
+var StorageQueries = []string{"python", "programming language", "\"programming language\"", "title:python", "url:perl", "snake*", "pythn~1", "asia -cobra"}
+
+func TestIndexDumpRoundTrip(t *testing.T) {
+	indexer := NewTestIndexer(t, ParserDocuments)
+	tests := []struct {
+		name   string
+		binary bool
+	}{
+		{"indexes.idx", true},
+		{"indexes.json", false},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		indexPath, dataPath := filepath.Join(directory, test.name), filepath.Join(directory, "data.json")
+		if err := indexer.SaveIndexDump(indexPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := indexer.SaveDataDump(dataPath); err != nil {
+			t.Fatal(err)
+		}
+		if binary, err := IsBinaryIndexDump(indexPath); err != nil || binary != test.binary {
+			t.Errorf("%s: expected the binary format %t, got %t (%v)", test.name, test.binary, binary, err)
+		}
+
+		loaded := NewIndexer()
+		if err := loaded.LoadIndexDump(indexPath); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := loaded.LoadDataDump(dataPath); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(loaded.Vocabulary, indexer.Vocabulary) {
+			t.Errorf("%s: the vocabulary differs", test.name)
+		}
+		for _, name := range Fields {
+			original, field := indexer.Fields[name], loaded.Fields[name]
+			if field.TotalLength != original.TotalLength || !reflect.DeepEqual(field.Lengths, original.Lengths) {
+				t.Errorf("%s: the lengths of the field %s differ", test.name, name)
+			}
+			if !reflect.DeepEqual(field.Positions, original.Positions) {
+				t.Errorf("%s: the positions of the field %s differ", test.name, name)
+			}
+		}
+		for _, query := range StorageQueries {
+			if titles, expected := SearchTitles(t, loaded, query), SearchTitles(t, indexer, query); !reflect.DeepEqual(titles, expected) {
+				t.Errorf("%s: %s: expected %v, got %v", test.name, query, expected, titles)
+			}
+		}
+		_ = loaded.Close()
+	}
+}
+
+func TestCorruptedIndexDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "indexes.idx")
+	if err := NewTestIndexer(t, ParserDocuments).SaveBinaryIndexDump(path); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections, err := ReadSectionTable(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 1+3*len(Fields) {
+		t.Fatalf("expected %d sections, got %d", 1+3*len(Fields), len(sections))
+	}
+	tableLength := int(binary.LittleEndian.Uint32(dump[8:12]))
+
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+		err     string
+	}{
+		{"magic", func(b []byte) []byte { b[0] = 'X'; return b }, ErrNotBinaryDump.Error()},
+		{"version", func(b []byte) []byte { b[4]++; return b }, "unsupported index dump version"},
+		{"truncated table", func(b []byte) []byte { return b[:IndexHeaderSize+tableLength/2] }, "index dump is truncated"},
+		{"table", func(b []byte) []byte { b[IndexHeaderSize+1]++; return b }, "section table checksum mismatch"},
+		{"truncated section", func(b []byte) []byte { return b[:len(b)-1] }, "is truncated"},
+		{"vocabulary", func(b []byte) []byte { b[sections[VocabularySection].Offset]++; return b }, "section vocabulary checksum mismatch"},
+		{"lengths", func(b []byte) []byte { b[sections[LengthsSection+TitleField].Offset]++; return b }, "section lengths/title checksum mismatch"},
+		{"dictionary", func(b []byte) []byte { b[sections[DictionarySection+AbstractField].Offset]++; return b }, "section dictionary/abstract checksum mismatch"},
+		{"postings", func(b []byte) []byte {
+			section := sections[PostingsSection+UrlField]
+			b[section.Offset+section.Length-1]++
+			return b
+		}, "section postings/url checksum mismatch"},
+	}
+	for _, test := range tests {
+		corrupted := filepath.Join(t.TempDir(), "indexes.idx")
+		if err := os.WriteFile(corrupted, test.corrupt(append([]byte(nil), dump...)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := NewIndexer().LoadBinaryIndexDump(corrupted)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected the error %q, got %v", test.name, test.err, err)
+		}
+		if test.name == "magic" && !errors.Is(err, ErrNotBinaryDump) {
+			t.Errorf("%s: expected the error to wrap ErrNotBinaryDump, got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,610 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// The segments are binary index dumps with an additional documents section, which keeps the stored
+// documents of the segment as uvarint count | count * (index delta uvarint | title | url | abstract).
+// The document indexes of a segment are the indexes of the live index, so the segments have no base.
+const (
+	SegmentsManifest = "segments.json"
+	SegmentFile      = "segment-%08d.seg"
+	SegmentExtension = ".seg"
+	TemporarySuffix  = ".tmp"
+	DocumentsSection = "documents"
+	MergeFactor      = 10
+	FlushInterval    = 10 * time.Second
+)
+
+type SegmentStoreInterface interface {
+	Start(interval time.Duration)
+	Resume(interval time.Duration) error
+	NumberOfModifications() uint64
+	Flush() error
+	Compact() error
+	Close() error
+	RotateLog() (uint64, error)
+	CheckpointLog(sequence uint64) error
+	ReadManifest() error
+	WriteManifest(segments []*StoredSegment, deleted *roaring.Bitmap) error
+	WriteSegment(documents []WikiXMLDoc) (*StoredSegment, error)
+	RemoveOrphans() error
+}
+
+// StoredSegment is an immutable segment of the store having its own term dictionaries, postings and
+// stored documents. Documents is the number of the documents written into the segment.
+type StoredSegment struct {
+	Name      string                  `json:"name"`
+	Documents uint64                  `json:"documents"`
+	Mapped    *MappedIndex            `json:"-"`
+	Fields    map[string]*MappedField `json:"-"`
+}
+
+// SegmentManifest lists the segments of the store along with the deleted documents. The segments are
+// written before the manifest referencing them, so the files missing from the manifest are the
+// leftovers of an interrupted flush or merge.
+type SegmentManifest struct {
+	Generation uint64           `json:"generation"`
+	Segments   []*StoredSegment `json:"segments"`
+	Deleted    []byte           `json:"deleted"`
+}
+
+// SegmentStore persists the documents modified on the live index as immutable segments. The documents
+// added since the last flush are kept in the memory of the indexer and written into a new segment on
+// every flush, and the segments of the same tier are merged once there are MergeFactor of them, which
+// drops the deleted documents and keeps the number of the segments logarithmic. Mutex serializes the
+// flushes and the merges, while the indexer is searched across the in-memory postings and the segments.
+type SegmentStore struct {
+	Directory string
+	Indexer   *Indexer
+	Manifest  SegmentManifest
+	Deleted   *roaring.Bitmap
+	Mutex     sync.Mutex
+	Done      chan bool
+	WaitGroup sync.WaitGroup
+}
+
+// OpenSegmentStore maps the segments of the directory into the indexer and applies the deleted
+// documents, which might be documents of the abstract files loaded into the indexer as well. The
+// modifications recorded by the write-ahead log after the last flush are replayed afterwards.
+func OpenSegmentStore(directory string, indexer *Indexer) (*SegmentStore, error) {
+	t0 := time.Now()
+	defer func(t0 time.Time) {
+		fmt.Printf("Opening the segment store took %f seconds\n", time.Since(t0).Seconds())
+	}(t0)
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	s := &SegmentStore{
+		Directory: directory,
+		Indexer:   indexer,
+		Deleted:   roaring.NewBitmap(),
+	}
+	if err := s.ReadManifest(); err != nil {
+		return nil, err
+	}
+	if err := s.RemoveOrphans(); err != nil {
+		fmt.Printf("Error removing the orphan segments: %s\n", err.Error())
+	}
+
+	documents := make([][]WikiXMLDoc, len(s.Manifest.Segments))
+	vocabularies := make([]map[string]string, len(s.Manifest.Segments))
+	for n, segment := range s.Manifest.Segments {
+		err := s.OpenSegment(segment)
+		if err == nil {
+			documents[n], err = segment.StoredDocuments()
+		}
+		if err == nil {
+			vocabularies[n], err = segment.Mapped.Vocabulary()
+		}
+		if err != nil {
+			s.CloseSegments()
+			return nil, fmt.Errorf("%s: %w", segment.Name, err)
+		}
+	}
+
+	s.mapSegments(documents, vocabularies)
+
+	log, records, err := OpenWriteAheadLog(directory)
+	if err != nil {
+		return nil, err
+	}
+	indexer.ReplayLog(records)
+	indexer.LogMutex.Lock()
+	indexer.Log = log
+	indexer.LogMutex.Unlock()
+	fmt.Printf("There are %d segments, %d deleted documents and %d replayed modifications in %s\n", len(s.Manifest.Segments), s.Deleted.GetCardinality(), len(records), directory)
+	return s, nil
+}
+
+func (s *SegmentStore) mapSegments(documents [][]WikiXMLDoc, vocabularies []map[string]string) {
+	i := s.Indexer
+	i.SearchMutex.Lock()
+	defer i.SearchMutex.Unlock()
+	for _, index := range s.Deleted.ToArray() {
+		if _, exists := i.Data[index]; exists {
+			i.deleteDocument(index)
+		}
+	}
+	for n, segment := range s.Manifest.Segments {
+		for _, name := range Fields {
+			i.Fields[name].Map(segment.Fields[name])
+		}
+		i.Mapped = append(i.Mapped, segment.Mapped)
+		i.AddWords(vocabularies[n])
+		for _, doc := range documents[n] {
+			if s.Deleted.Contains(doc.Index) {
+				for _, name := range Fields {
+					i.Fields[name].RemoveLength(doc.Index)
+				}
+				continue
+			}
+			i.Data[doc.Index] = doc
+			i.Documents.Add(doc.Index)
+			i.Completer.Add(doc)
+		}
+	}
+	i.Deleted.Or(s.Deleted)
+	i.Modified()
+	// The new documents are numbered after the documents of the segments
+	i.NextIndex = 0
+}
+
+// Start flushes and merges the segments periodically in the background until the store is closed
+func (s *SegmentStore) Start(interval time.Duration) {
+	s.Done = make(chan bool)
+	s.WaitGroup.Add(1)
+	go func() {
+		defer s.WaitGroup.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.Done:
+				return
+			case <-ticker.C:
+			}
+			if err := s.Flush(); err != nil {
+				fmt.Printf("Error flushing the segment store: %s\n", err.Error())
+			}
+			if err := s.Compact(); err != nil {
+				fmt.Printf("Error merging the segments: %s\n", err.Error())
+			}
+		}
+	}()
+}
+
+// Close stops the background goroutine, flushes the buffered documents and closes the write-ahead log.
+// The segments remain mapped into the indexer, they are unmapped when the indexer is closed.
+func (s *SegmentStore) Close() error {
+	if s.Done != nil {
+		close(s.Done)
+		s.WaitGroup.Wait()
+		s.Done = nil
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	i := s.Indexer
+	i.LogMutex.Lock()
+	defer i.LogMutex.Unlock()
+	if i.Log == nil {
+		return nil
+	}
+	err := i.Log.Close()
+	i.Log = nil
+	return err
+}
+
+// Resume reopens the write-ahead log of the closed store and restarts the background flushes, e.g. once
+// the indexer of the store keeps serving after a failed reload. The log is empty, since Close has
+// flushed the modifications and checkpointed the log.
+func (s *SegmentStore) Resume(interval time.Duration) error {
+	i := s.Indexer
+	i.LogMutex.Lock()
+	defer i.LogMutex.Unlock()
+	if i.Log == nil {
+		log, records, err := OpenWriteAheadLog(s.Directory)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			_ = log.Close()
+			return fmt.Errorf("%w: %d records are left after closing the store", ErrCorruptedLog, len(records))
+		}
+		i.Log = log
+	}
+	s.Start(interval)
+	return nil
+}
+
+// NumberOfModifications returns the number of the documents written into the segments and the number
+// of the deleted documents, an update counts as both
+func (s *SegmentStore) NumberOfModifications() uint64 {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	modifications := s.Deleted.GetCardinality()
+	for _, segment := range s.Manifest.Segments {
+		modifications += segment.Documents
+	}
+	return modifications
+}
+
+// Flush writes the documents added since the last flush into a new segment, and replaces their
+// in-memory postings with the segment. The manifest is rewritten if there are new deleted documents.
+// The write-ahead log is rotated along with the snapshot of the modifications, and the files before
+// the rotation are removed once the manifest is written. The manifest keeps the deleted documents of
+// the snapshot, since the later deletions are only recorded by the log files after the rotation.
+func (s *SegmentStore) Flush() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	i := s.Indexer
+	i.LogMutex.Lock()
+	i.SearchMutex.RLock()
+	buffered := i.Buffered.Clone()
+	documents := make([]WikiXMLDoc, 0, buffered.GetCardinality())
+	for _, index := range buffered.ToArray() {
+		documents = append(documents, i.Data[index])
+	}
+	deleted := i.Deleted.Clone()
+	if len(documents) == 0 && deleted.Equals(s.Deleted) {
+		i.SearchMutex.RUnlock()
+		i.LogMutex.Unlock()
+		return nil
+	}
+	// The modifications are appended to the log and applied holding the LogMutex, so the log is
+	// rotated exactly at the snapshot
+	checkpoint, err := s.RotateLog()
+	i.SearchMutex.RUnlock()
+	i.LogMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(documents) == 0 {
+		if err := s.WriteManifest(s.Manifest.Segments, deleted); err != nil {
+			return err
+		}
+		return s.CheckpointLog(checkpoint)
+	}
+
+	t0 := time.Now()
+	segment, err := s.WriteSegment(documents)
+	if err != nil {
+		return err
+	}
+
+	i.SearchMutex.Lock()
+	for _, name := range Fields {
+		i.Fields[name].Mapped = append(i.Fields[name].Mapped, segment.Fields[name])
+	}
+	i.Mapped = append(i.Mapped, segment.Mapped)
+	for _, doc := range documents {
+		if _, exists := i.Data[doc.Index]; exists {
+			i.evictDocument(doc)
+			continue
+		}
+		// The document was deleted during the flush, so its length is already removed
+		for _, name := range Fields {
+			i.Fields[name].Lengths[doc.Index] = 0
+		}
+	}
+	i.Buffered.AndNot(buffered)
+	i.SearchMutex.Unlock()
+
+	segments := make([]*StoredSegment, 0, len(s.Manifest.Segments)+1)
+	segments = append(segments, s.Manifest.Segments...)
+	segments = append(segments, segment)
+	if err := s.WriteManifest(segments, deleted); err != nil {
+		return err
+	}
+	fmt.Printf("Flushing %d documents into %s took %f seconds\n", len(documents), segment.Name, time.Since(t0).Seconds())
+	return s.CheckpointLog(checkpoint)
+}
+
+// RotateLog rotates the write-ahead log of the indexer and returns the sequence to checkpoint, the
+// caller must hold the LogMutex of the indexer
+func (s *SegmentStore) RotateLog() (uint64, error) {
+	if s.Indexer.Log == nil {
+		return 0, nil
+	}
+	return s.Indexer.Log.Rotate()
+}
+
+// CheckpointLog removes the log files before the sequence. The log of the indexer is only replaced by
+// the store, so it can be used without the LogMutex.
+func (s *SegmentStore) CheckpointLog(sequence uint64) error {
+	if s.Indexer.Log == nil || sequence == 0 {
+		return nil
+	}
+	return s.Indexer.Log.Checkpoint(sequence)
+}
+
+// SegmentTier returns the order of magnitude of the number of the documents in base MergeFactor
+func SegmentTier(documents uint64) int {
+	tier := 0
+	for ; documents >= MergeFactor; documents /= MergeFactor {
+		tier++
+	}
+	return tier
+}
+
+// Compact merges the oldest MergeFactor segments of a tier if there is such a tier, the merged segment
+// is usually promoted to the next tier so every document is merged about log(n) times
+func (s *SegmentStore) Compact() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	tiers := map[int][]*StoredSegment{}
+	for _, segment := range s.Manifest.Segments {
+		tier := SegmentTier(segment.Documents)
+		tiers[tier] = append(tiers[tier], segment)
+		if len(tiers[tier]) == MergeFactor {
+			return s.merge(tiers[tier])
+		}
+	}
+	return nil
+}
+
+// merge writes the live documents of the segments into a new segment and swaps them, the deleted
+// documents of the segments are purged from the deleted documents of the indexer. Only the deletions
+// persisted by the manifest are purged, the documents deleted since the last flush are merged along
+// with the live ones, since the records of their deletions are not checkpointed yet and replaying an
+// update needs the previous version of the document.
+func (s *SegmentStore) merge(segments []*StoredSegment) error {
+	t0 := time.Now()
+	i := s.Indexer
+	deleted := s.Deleted
+
+	documents := make([]WikiXMLDoc, 0)
+	purged := roaring.NewBitmap()
+	merging := make(map[*MappedIndex]bool, len(segments))
+	fields := make(map[*MappedField]bool, len(segments)*len(Fields))
+	for _, segment := range segments {
+		stored, err := segment.StoredDocuments()
+		if err != nil {
+			return fmt.Errorf("%s: %w", segment.Name, err)
+		}
+		for _, doc := range stored {
+			if deleted.Contains(doc.Index) {
+				purged.Add(doc.Index)
+			} else {
+				documents = append(documents, doc)
+			}
+		}
+		merging[segment.Mapped] = true
+		for _, field := range segment.Fields {
+			fields[field] = true
+		}
+	}
+	var merged *StoredSegment
+	if len(documents) > 0 {
+		var err error
+		if merged, err = s.WriteSegment(documents); err != nil {
+			return err
+		}
+	}
+
+	i.SearchMutex.Lock()
+	for _, name := range Fields {
+		field := i.Fields[name]
+		mapped := make([]*MappedField, 0, len(field.Mapped))
+		for _, m := range field.Mapped {
+			if !fields[m] {
+				mapped = append(mapped, m)
+			}
+		}
+		if merged != nil {
+			mapped = append(mapped, merged.Fields[name])
+		}
+		field.Mapped = mapped
+		for _, index := range purged.ToArray() {
+			delete(field.Lengths, index)
+		}
+	}
+	indexes := make([]*MappedIndex, 0, len(i.Mapped))
+	for _, m := range i.Mapped {
+		if !merging[m] {
+			indexes = append(indexes, m)
+		}
+	}
+	if merged != nil {
+		indexes = append(indexes, merged.Mapped)
+	}
+	i.Mapped = indexes
+	i.Deleted.AndNot(purged)
+	// The terms of the purged documents might be gone
+	i.Modified()
+	i.SearchMutex.Unlock()
+
+	kept := make([]*StoredSegment, 0, len(s.Manifest.Segments))
+	for _, segment := range s.Manifest.Segments {
+		if !merging[segment.Mapped] {
+			kept = append(kept, segment)
+		}
+	}
+	if merged != nil {
+		kept = append(kept, merged)
+	}
+	if err := s.WriteManifest(kept, roaring.AndNot(deleted, purged)); err != nil {
+		return err
+	}
+	// The searches using the merged segments hold the SearchMutex, so they are done by now
+	for _, segment := range segments {
+		if err := segment.Mapped.Close(); err != nil {
+			fmt.Printf("Error unmapping the segment %s: %s\n", segment.Name, err.Error())
+		}
+		if err := os.Remove(filepath.Join(s.Directory, segment.Name)); err != nil {
+			fmt.Printf("Error removing the segment %s: %s\n", segment.Name, err.Error())
+		}
+	}
+	fmt.Printf("Merging %d segments into %d documents took %f seconds\n", len(segments), len(documents), time.Since(t0).Seconds())
+	return nil
+}
+
+// WriteSegment indexes the documents into a new segment of the directory and maps it
+func (s *SegmentStore) WriteSegment(documents []WikiXMLDoc) (*StoredSegment, error) {
+	sort.Slice(documents, func(a, b int) bool { return documents[a].Index < documents[b].Index })
+	indexer := NewIndexer()
+	for _, doc := range documents {
+		indexer.AddIndex(TitleField, s.Indexer.AnalyzeTokens(doc.Title), doc.Index)
+		indexer.AddIndex(AbstractField, s.Indexer.AnalyzeTokens(doc.Abstract), doc.Index)
+		indexer.AddIndex(UrlField, s.Indexer.AnalyzeTokens(UrlPath(doc.Url)), doc.Index)
+	}
+	names, sections, err := indexer.IndexSections()
+	if err != nil {
+		return nil, err
+	}
+	stored := &sectionWriter{}
+	stored.PutUvarint(uint64(len(documents)))
+	previous := uint32(0)
+	for _, doc := range documents {
+		stored.PutUvarint(uint64(doc.Index - previous))
+		stored.PutString(doc.Title)
+		stored.PutString(doc.Url)
+		stored.PutString(doc.Abstract)
+		previous = doc.Index
+	}
+	names = append(names, DocumentsSection)
+	sections[DocumentsSection] = stored
+
+	s.Manifest.Generation++
+	segment := &StoredSegment{
+		Name:      fmt.Sprintf(SegmentFile, s.Manifest.Generation),
+		Documents: uint64(len(documents)),
+	}
+	if err := WriteSections(filepath.Join(s.Directory, segment.Name), names, sections); err != nil {
+		return nil, err
+	}
+	return segment, s.OpenSegment(segment)
+}
+
+// OpenSegment maps the segment and decodes the dictionaries of its fields
+func (s *SegmentStore) OpenSegment(segment *StoredSegment) error {
+	mapped, err := OpenMappedIndex(filepath.Join(s.Directory, segment.Name))
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]*MappedField, len(Fields))
+	for _, name := range Fields {
+		field, err := mapped.Field(name)
+		if err != nil {
+			_ = mapped.Close()
+			return err
+		}
+		fields[name] = field
+	}
+	segment.Mapped = mapped
+	segment.Fields = fields
+	return nil
+}
+
+// CloseSegments unmaps the segments of the manifest which are not mapped into the indexer yet
+func (s *SegmentStore) CloseSegments() {
+	for _, segment := range s.Manifest.Segments {
+		if segment.Mapped != nil {
+			_ = segment.Mapped.Close()
+		}
+	}
+}
+
+// StoredDocuments decodes the documents of the segment
+func (segment *StoredSegment) StoredDocuments() ([]WikiXMLDoc, error) {
+	b, err := SectionBytes(segment.Mapped.Data, segment.Mapped.Sections, DocumentsSection)
+	if err != nil {
+		return nil, err
+	}
+	reader := &SectionReader{Buffer: b}
+	count := reader.Uvarint()
+	if count > uint64(len(b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	documents := make([]WikiXMLDoc, 0, count)
+	index := uint32(0)
+	for n := uint64(0); n < count && reader.Err == nil; n++ {
+		index += uint32(reader.Uvarint())
+		documents = append(documents, WikiXMLDoc{
+			Index:    index,
+			Title:    reader.String(),
+			Url:      reader.String(),
+			Abstract: reader.String(),
+		})
+	}
+	return documents, reader.Err
+}
+
+func (s *SegmentStore) ReadManifest() error {
+	b, err := os.ReadFile(filepath.Join(s.Directory, SegmentsManifest))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &s.Manifest); err != nil {
+		return err
+	}
+	if len(s.Manifest.Deleted) > 0 {
+		return s.Deleted.UnmarshalBinary(s.Manifest.Deleted)
+	}
+	return nil
+}
+
+// WriteManifest replaces the manifest atomically
+func (s *SegmentStore) WriteManifest(segments []*StoredSegment, deleted *roaring.Bitmap) error {
+	b, err := deleted.ToBytes()
+	if err != nil {
+		return err
+	}
+	manifest := SegmentManifest{
+		Generation: s.Manifest.Generation,
+		Segments:   segments,
+		Deleted:    b,
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = WriteFileAtomic(filepath.Join(s.Directory, SegmentsManifest), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.Manifest = manifest
+	s.Deleted = deleted
+	return nil
+}
+
+// RemoveOrphans removes the segments and the temporary files which are not referenced by the manifest
+func (s *SegmentStore) RemoveOrphans() error {
+	files, err := os.ReadDir(s.Directory)
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool, len(s.Manifest.Segments))
+	for _, segment := range s.Manifest.Segments {
+		referenced[segment.Name] = true
+	}
+	for _, f := range files {
+		name := f.Name()
+		if (strings.HasSuffix(name, SegmentExtension) && !referenced[name]) || strings.HasSuffix(name, TemporarySuffix) {
+			if err := os.Remove(filepath.Join(s.Directory, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
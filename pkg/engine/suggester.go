@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	DefaultSuggestionThreshold = 5
+	SuggestionRatio            = 10
+	ShortWordLength            = 4
+)
+
+type SuggesterInterface interface {
+	Suggest(ctx context.Context, s string, results int) string
+}
+
+// Suggester proposes a corrected query when a query produces fewer results than the Threshold.
+// Every word of the query is replaced by the word within the edit distance having the highest
+// document frequency, if that frequency is SuggestionRatio times higher than the frequency of the
+// original word.
+type Suggester struct {
+	Indexer   *Indexer
+	Threshold int
+}
+
+func NewSuggester(indexer *Indexer, threshold int) *Suggester {
+	return &Suggester{
+		Indexer:   indexer,
+		Threshold: threshold,
+	}
+}
+
+// Suggest returns the corrected query or an empty string if there is no better query, or if the
+// context is done before the suggestion is evaluated
+func (s *Suggester) Suggest(ctx context.Context, query string, results int) string {
+	if results >= s.Threshold {
+		return ""
+	}
+	suggestion := query
+	corrected := false
+	tokens := LexQuery(query)
+	// Replacing the words from the end keeps the offsets of the preceding tokens valid
+	for idx := len(tokens) - 1; idx >= 0; idx-- {
+		if ctx.Err() != nil {
+			return ""
+		}
+		token := tokens[idx]
+		if token.Kind != WordToken || IsWildcard(token.Text) || strings.Contains(token.Text, "~") {
+			continue
+		}
+		if word, ok := s.Correct(token.Text); ok {
+			suggestion = suggestion[:token.Start] + word + suggestion[token.End:]
+			corrected = true
+		}
+	}
+	if !corrected {
+		return ""
+	}
+
+	// The suggestion is only returned if it matches more documents than the original query
+	parsed, err := NewQueryParser(s.Indexer).Parse(suggestion)
+	if err != nil || parsed == nil {
+		return ""
+	}
+	matched := s.Indexer.Live(parsed.Evaluate(ctx, s.Indexer))
+	if ctx.Err() != nil || int(matched.GetCardinality()) <= results {
+		return ""
+	}
+	return suggestion
+}
+
+// Correct returns the most frequent word within the edit distance of the given word
+func (s *Suggester) Correct(text string) (string, bool) {
+	tokens := s.Indexer.AnalyzeTokens(text)
+	if len(tokens) != 1 {
+		return "", false
+	}
+	word, stem := tokens[0].Word, tokens[0].Term
+	distance := MaxFuzziness
+	if len([]rune(word)) <= ShortWordLength {
+		distance = 1
+	}
+
+	frequency := s.Indexer.DocumentFrequency(stem)
+	best, bestFrequency := "", frequency*SuggestionRatio
+	for _, match := range s.Indexer.FuzzyTree().Search(word, distance) {
+		candidate, exists := s.Indexer.Vocabulary[match.Word]
+		if !exists || candidate == stem {
+			continue
+		}
+		if f := s.Indexer.DocumentFrequency(candidate); f > bestFrequency || (f == bestFrequency && f > 0 && match.Word < best) {
+			best, bestFrequency = match.Word, f
+		}
+	}
+	return best, best != ""
+}
+
+// DocumentFrequency returns the number of the live documents containing the term within the DefaultFields
+func (i *Indexer) DocumentFrequency(term string) uint64 {
+	indexes := i.TermBitmap("", term)
+	if indexes == nil {
+		return 0
+	}
+	if i.Deleted.IsEmpty() {
+		return indexes.GetCardinality()
+	}
+	return indexes.GetCardinality() - indexes.AndCardinality(i.Deleted)
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	documents := []WikiXMLDoc{
+		{Title: "Pythn", Abstract: "a misspelled article"},
+		{Title: "Languages", Abstract: "a list of languages"},
+	}
+	for idx := 0; idx < 12; idx++ {
+		documents = append(documents, WikiXMLDoc{Title: fmt.Sprintf("Python %d", idx), Abstract: "python is a programming language"})
+	}
+	indexer := NewTestIndexer(t, documents)
+	tests := []struct {
+		query      string
+		results    int
+		suggestion string
+	}{
+		{"pyhton", 0, "python"},
+		{"pyhton language", 0, "python language"},
+		{"title:pyhton", 0, "title:python"},
+		{"(pyhton OR perl)", 0, "(python OR perl)"},
+		// The word is 10 times less frequent than its correction
+		{"pythn", 1, "python"},
+		// The word is not 10 times less frequent than its correction
+		{"languag", 0, ""},
+		{"python", 12, ""},
+		{"pyhton", DefaultSuggestionThreshold, ""},
+		{`"pyhton"`, 0, ""},
+		{"pyth*", 0, ""},
+		{"pyhton~1", 0, ""},
+		{"xyzzy", 0, ""},
+	}
+	for _, test := range tests {
+		if suggestion := indexer.Suggester.Suggest(context.Background(), test.query, test.results); suggestion != test.suggestion {
+			t.Errorf("%s: expected %q, got %q", test.query, test.suggestion, suggestion)
+		}
+	}
+
+	results, err := indexer.Search("pyhton", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.NumberOfResults != 0 || results.Suggestion != "python" {
+		t.Errorf("expected the suggestion python, got %q", results.Suggestion)
+	}
+}
+
+func TestSuggestLiveDocuments(t *testing.T) {
+	documents := []WikiXMLDoc{{Title: "Pythn", Abstract: "a misspelled article"}}
+	for idx := 0; idx < 12; idx++ {
+		documents = append(documents, WikiXMLDoc{Title: fmt.Sprintf("Python %d", idx), Abstract: "python is a programming language"})
+	}
+	// The postings of the mapped dump keep the deleted documents
+	indexer := OpenTestIndexDump(t, NewTestIndexer(t, documents))
+	indexer.BuildFuzzyTree()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		deleted    int
+		frequency  uint64
+		suggestion string
+	}{
+		{"live documents", context.Background(), 0, 12, "python"},
+		{"canceled context", canceled, 0, 12, ""},
+		{"few live documents", context.Background(), 10, 2, ""},
+	}
+	for _, test := range tests {
+		for idx := 0; idx < test.deleted; idx++ {
+			if _, err := indexer.DeleteDocument(fmt.Sprintf("https://en.wikipedia.org/wiki/Python_%d", idx)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if frequency := indexer.DocumentFrequency("python"); frequency != test.frequency {
+			t.Errorf("%s: expected the frequency %d, got %d", test.name, test.frequency, frequency)
+		}
+		if suggestion := indexer.Suggester.Suggest(test.ctx, "pythn", 1); suggestion != test.suggestion {
+			t.Errorf("%s: expected %q, got %q", test.name, test.suggestion, suggestion)
+		}
+	}
+}
@@ -5,8 +5,21 @@ import (
 	"unicode"
 )
 
+// Token is an analyzed term with its position within the original token stream. Positions are
+// assigned before the stop words are removed, so the gaps left by the stop words are preserved.
+// Word is the lowercased surface form of the term before stemming, Start and End are the byte
+// offsets of the word within the analyzed string.
+type Token struct {
+	Term     string
+	Word     string
+	Position uint32
+	Start    int
+	End      int
+}
+
 type TokenizerInterface interface {
 	Tokenize(s string) []string
+	TokenizeWithOffsets(s string) []Token
 }
 
 type Tokenizer struct {}
@@ -16,8 +29,31 @@ func NewTokenizer() *Tokenizer {
 }
 
 func (t *Tokenizer) Tokenize(s string) []string {
-	tokens := strings.FieldsFunc(s, func(r rune) bool {
-		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
-	})
+	tokens := strings.FieldsFunc(s, IsSeparator)
 	return tokens
 }
+
+// TokenizeWithOffsets splits the string the same way as Tokenize, while keeping the position and
+// the byte offsets of every word. The Term and the Word of the returned tokens are the raw words.
+func (t *Tokenizer) TokenizeWithOffsets(s string) []Token {
+	tokens := make([]Token, 0)
+	start := -1
+	for idx, r := range s {
+		if IsSeparator(r) {
+			if start >= 0 {
+				tokens = append(tokens, Token{Term: s[start:idx], Word: s[start:idx], Position: uint32(len(tokens)), Start: start, End: idx})
+				start = -1
+			}
+		} else if start < 0 {
+			start = idx
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, Token{Term: s[start:], Word: s[start:], Position: uint32(len(tokens)), Start: start, End: len(s)})
+	}
+	return tokens
+}
+
+func IsSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
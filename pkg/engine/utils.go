@@ -2,8 +2,28 @@ package engine
 
 import (
 	"math"
+	"time"
 )
 
+// ElapsedSince returns the processing time in milliseconds, the precision is microseconds for the
+// durations shorter than a millisecond
+func ElapsedSince(t0 time.Time) Processed {
+	var duration float64
+	elapsed := time.Since(t0)
+	microseconds := elapsed.Microseconds()
+	milliseconds := elapsed.Milliseconds()
+
+	if microseconds > 1000 {
+		duration = float64(milliseconds)
+	} else {
+		duration = float64(microseconds) / 1000.0
+	}
+	return Processed{
+		Duration: duration,
+		Unit:     "milliseconds",
+	}
+}
+
 func GetNumberOfPages(total int, pageSize int) int {
 	return int(math.Ceil(float64(total) / float64(pageSize)))
 }
@@ -17,4 +37,35 @@ func SliceSearchResults(results []SearchResult, currentPage int) []SearchResult
 		high = total
 	}
 	return results[low:high]
-}
\ No newline at end of file
+}
+
+// UniqueTerms removes the duplicated terms of the same field by keeping the highest weight
+func UniqueTerms(terms []QueryTerm) []QueryTerm {
+	seen := make(map[string]int, len(terms))
+	unique := make([]QueryTerm, 0, len(terms))
+	for idx := range terms {
+		term := terms[idx]
+		key := term.Field + ":" + term.Term
+		if n, exists := seen[key]; exists {
+			unique[n].Weight = math.Max(unique[n].Weight, term.Weight)
+		} else {
+			seen[key] = len(unique)
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+func MaxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func MinInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
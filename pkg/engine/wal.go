@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The write-ahead log is a sequence of files with the following records (fixed size integers are
+// little endian):
+//
+//	record    payload length uint32 | payload checksum uint32 | payload
+//	payload   operation byte | index uvarint | title | url | abstract
+//
+// The index is the index of the added or updated document, or the index of the deleted document. A
+// record is synced before the modification is applied to the indexer. The files are numbered, so a
+// flush rotates the log and removes the files covered by the flushed segment once the manifest is
+// written. A torn record at the end of the last file is the result of a crash while appending it.
+// Saving the index and the data dumps does not truncate the log, since the dumps only keep the
+// documents of the abstract files and the modifications are persisted by the segments instead.
+const (
+	LogFile       = "wal-%08d.log"
+	LogPrefix     = "wal-"
+	LogExtension  = ".log"
+	LogHeaderSize = 8
+)
+
+const (
+	LogAdd    = byte(0)
+	LogUpdate = byte(1)
+	LogDelete = byte(2)
+)
+
+var ErrCorruptedLog = errors.New("corrupted write-ahead log record")
+
+type WriteAheadLogInterface interface {
+	Append(operation byte, doc WikiXMLDoc) error
+	Rotate() (uint64, error)
+	Checkpoint(sequence uint64) error
+	Close() error
+}
+
+// LogRecord is a document modification, the document of LogDelete only has the url and the index
+type LogRecord struct {
+	Operation byte
+	Document  WikiXMLDoc
+}
+
+// WriteAheadLog appends the document modifications into the file of the current Sequence
+type WriteAheadLog struct {
+	Directory string
+	Sequence  uint64
+	File      *os.File
+	Mutex     sync.Mutex
+}
+
+// OpenWriteAheadLog reads the records of the log files in the directory, and opens the last file for
+// appending after cutting its torn record off
+func OpenWriteAheadLog(directory string) (*WriteAheadLog, []LogRecord, error) {
+	sequences, err := LogSequences(directory)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &WriteAheadLog{Directory: directory, Sequence: 1}
+	records := make([]LogRecord, 0)
+	for n, sequence := range sequences {
+		path := l.Path(sequence)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		read, valid, err := DecodeLogRecords(b)
+		records = append(records, read...)
+		if err != nil {
+			fmt.Printf("%s: %s after %d records\n", path, err.Error(), len(read))
+			if n == len(sequences)-1 {
+				if err := os.Truncate(path, int64(valid)); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		l.Sequence = sequence
+	}
+	if l.File, err = os.OpenFile(l.Path(l.Sequence), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, nil, err
+	}
+	return l, records, nil
+}
+
+// LogSequences returns the sorted sequence numbers of the log files in the directory
+func LogSequences(directory string) ([]uint64, error) {
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	sequences := make([]uint64, 0)
+	for _, f := range files {
+		var sequence uint64
+		if !strings.HasPrefix(f.Name(), LogPrefix) || !strings.HasSuffix(f.Name(), LogExtension) {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), LogFile, &sequence); err == nil {
+			sequences = append(sequences, sequence)
+		}
+	}
+	sort.Slice(sequences, func(a, b int) bool { return sequences[a] < sequences[b] })
+	return sequences, nil
+}
+
+// DecodeLogRecords decodes the records of a log file, and returns the records before the first torn or
+// corrupted record along with their length
+func DecodeLogRecords(b []byte) ([]LogRecord, int, error) {
+	records := make([]LogRecord, 0)
+	offset := 0
+	for offset < len(b) {
+		if len(b)-offset < LogHeaderSize {
+			return records, offset, ErrCorruptedLog
+		}
+		length := int(binary.LittleEndian.Uint32(b[offset : offset+4]))
+		checksum := binary.LittleEndian.Uint32(b[offset+4 : offset+8])
+		if length < 1 || len(b)-offset-LogHeaderSize < length {
+			return records, offset, ErrCorruptedLog
+		}
+		payload := b[offset+LogHeaderSize : offset+LogHeaderSize+length]
+		if crc32.Checksum(payload, CastagnoliTable) != checksum {
+			return records, offset, ErrCorruptedLog
+		}
+		reader := &SectionReader{Buffer: payload[1:]}
+		record := LogRecord{
+			Operation: payload[0],
+			Document: WikiXMLDoc{
+				Index:    uint32(reader.Uvarint()),
+				Title:    reader.String(),
+				Url:      reader.String(),
+				Abstract: reader.String(),
+			},
+		}
+		if reader.Err != nil {
+			return records, offset, ErrCorruptedLog
+		}
+		records = append(records, record)
+		offset += LogHeaderSize + length
+	}
+	return records, offset, nil
+}
+
+func (l *WriteAheadLog) Path(sequence uint64) string {
+	return filepath.Join(l.Directory, fmt.Sprintf(LogFile, sequence))
+}
+
+// Append writes the record of the modification and syncs the file
+func (l *WriteAheadLog) Append(operation byte, doc WikiXMLDoc) error {
+	payload := &sectionWriter{}
+	payload.WriteByte(operation)
+	payload.PutUvarint(uint64(doc.Index))
+	payload.PutString(doc.Title)
+	payload.PutString(doc.Url)
+	payload.PutString(doc.Abstract)
+	record := make([]byte, LogHeaderSize, LogHeaderSize+payload.Len())
+	binary.LittleEndian.PutUint32(record[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload.Bytes(), CastagnoliTable))
+	record = append(record, payload.Bytes()...)
+
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if _, err := l.File.Write(record); err != nil {
+		return err
+	}
+	return l.File.Sync()
+}
+
+// Rotate continues the log in a new file and returns its sequence, the records of the previous files
+// are removed by the checkpoint of the sequence
+func (l *WriteAheadLog) Rotate() (uint64, error) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	file, err := os.OpenFile(l.Path(l.Sequence+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.File.Close(); err != nil {
+		fmt.Printf("Error closing the write-ahead log: %s\n", err.Error())
+	}
+	l.File = file
+	l.Sequence++
+	return l.Sequence, nil
+}
+
+// Checkpoint removes the log files before the sequence, since their records are persisted by the segments
+func (l *WriteAheadLog) Checkpoint(sequence uint64) error {
+	sequences, err := LogSequences(l.Directory)
+	if err != nil {
+		return err
+	}
+	for _, n := range sequences {
+		if n < sequence {
+			if err := os.Remove(l.Path(n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *WriteAheadLog) Close() error {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return l.File.Close()
+}
@@ -1,29 +1,105 @@
 package tcpclient
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/xkmsoft/wikisearcher/pkg/engine"
 )
 
 const (
-	QUERY = byte(0)
+	QUERY    = byte(0)
+	COMPLETE = byte(1)
+	ADD      = byte(2)
+	UPDATE   = byte(3)
+	DELETE   = byte(4)
+	RELOAD   = byte(5)
 )
 
+// The frames of the protocol, see the tcpserver package for the layout
+const (
+	ProtocolVersion    = byte(3)
+	RequestHeaderSize  = 18
+	ResponseHeaderSize = 9
+	MaxResponseSize    = 1024 * 1024 * 64 // 64MB
+	StatusOK           = byte(0)
+	StatusError        = byte(1)
+)
+
+var (
+	ErrFrameTooLarge    = errors.New("frame exceeds the maximum length")
+	ErrConnectionClosed = errors.New("connection closed")
+	ErrReadTimeout      = errors.New("timeout waiting for the response")
+)
+
+// ResponseError is the error response of the server, the request reached the server unlike the errors
+// of the connection
+type ResponseError struct {
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
 type ClientInterface interface {
-	Query(s string) (*engine.SearchResults, error)
+	Query(s string, page uint32) (*engine.SearchResults, error)
+	Complete(prefix string, limit uint32) (*engine.CompletionResults, error)
+	AddDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error)
+	UpdateDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error)
+	DeleteDocument(url string) (*engine.DocumentResult, error)
+	SendDocument(request []byte) (*engine.DocumentResult, error)
+	Reload(refresh bool) (string, error)
 	PrepareQuery(s string, p uint32) []byte
+	PrepareRequest(command byte, s string, p uint32) []byte
+	QueryContext(ctx context.Context, s string, page uint32) (*engine.SearchResults, error)
+	CompleteContext(ctx context.Context, prefix string, limit uint32) (*engine.CompletionResults, error)
+	Send(request []byte) ([]byte, error)
+	SendContext(ctx context.Context, request []byte) ([]byte, error)
+	WriteDeadline(ctx context.Context) time.Time
+	Connect(ctx context.Context) (net.Conn, error)
+	ReadResponses(conn net.Conn)
+	Connected() bool
+	Close() error
 	Address() string
 }
 
+// ResponseFrame is a response of the server, Id is the id of the request
+type ResponseFrame struct {
+	Id      uint32
+	Status  byte
+	Payload []byte
+}
+
+// Response is the result of a request delivered to the goroutine waiting for it
+type Response struct {
+	Payload []byte
+	Err     error
+}
+
+// TCPClient keeps a single connection to the server and pipelines the requests of the concurrent
+// callers over it. The requests are numbered, and the goroutine reading the connection delivers the
+// responses to the callers by the ids of the requests, so the responses can arrive out of order. Mutex
+// guards the connection and the pending requests, while WriteMutex serializes the request frames. The
+// zero DialTimeout and ReadTimeout wait forever.
 type TCPClient struct {
-	Ip      string
-	Port    string
-	Network string
+	Ip          string
+	Port        string
+	Network     string
+	DialTimeout time.Duration
+	ReadTimeout time.Duration
+	Connection  net.Conn
+	Pending     map[uint32]chan Response
+	NextId      uint32
+	Mutex       sync.Mutex
+	WriteMutex  sync.Mutex
 }
 
 func NewTCPClient(ip string, port string, network string) *TCPClient {
@@ -31,13 +107,23 @@ func NewTCPClient(ip string, port string, network string) *TCPClient {
 		Ip:      ip,
 		Port:    port,
 		Network: network,
+		Pending: map[uint32]chan Response{},
 	}
 }
 
 func (c *TCPClient) PrepareQuery(s string, p uint32) []byte {
-	query := make([]byte, 0)
-	query = append(query, GetHeader(QUERY)...)
+	return c.PrepareRequest(QUERY, s, p)
+}
+
+// PrepareRequest returns the request frame of the command, the id of the request is set by Send
+func (c *TCPClient) PrepareRequest(command byte, s string, p uint32) []byte {
+	query := make([]byte, 0, RequestHeaderSize+len(s))
+	query = append(query, ProtocolVersion)
+	query = append(query, GetHeader(command)...)
+	query = append(query, Uint32ToBytes(0)...)
 	query = append(query, Uint32ToBytes(p)...)
+	query = append(query, Uint32ToBytes(0)...)
+	query = append(query, Uint32ToBytes(uint32(len(s)))...)
 	query = append(query, []byte(s)...)
 	return query
 }
@@ -46,39 +132,295 @@ func (c *TCPClient) Address() string {
 	return fmt.Sprintf("%s:%s", c.Ip, c.Port)
 }
 
-func (c *TCPClient) Query(s string, page uint32) (*engine.SearchResults, error) {
-
-	query := c.PrepareQuery(s, page)
-	address := c.Address()
+func (c *TCPClient) Send(request []byte) ([]byte, error) {
+	return c.SendContext(context.Background(), request)
+}
 
-	tcpAddr, err := net.ResolveTCPAddr(c.Network, address)
+// SendContext writes the request to the connection, which is dialed on the first request, and waits for
+// the response of the request. The error responses are returned as ResponseError. The connection is
+// closed if the response does not arrive within the ReadTimeout, since the connection is presumably
+// broken. The deadline of the context is sent along with the request, and the request is abandoned once
+// the context is done while the connection is kept for the other requests.
+func (c *TCPClient) SendContext(ctx context.Context, request []byte) ([]byte, error) {
+	if len(request) < RequestHeaderSize {
+		return nil, fmt.Errorf("invalid request length %d", len(request))
+	}
+	timeout, err := DeadlineTimeout(ctx)
 	if err != nil {
 		return nil, err
 	}
+	copy(request[10:14], Uint32ToBytes(timeout))
+	responses := make(chan Response, 1)
 
-	conn, err := net.DialTCP(c.Network, nil, tcpAddr)
+	c.Mutex.Lock()
+	conn, err := c.Connect(ctx)
 	if err != nil {
+		c.Mutex.Unlock()
 		return nil, err
 	}
+	c.NextId++
+	if c.NextId == 0 {
+		// The id 0 is reserved for the errors of the connection
+		c.NextId++
+	}
+	id := c.NextId
+	copy(request[2:6], Uint32ToBytes(id))
+	c.Pending[id] = responses
+	c.Mutex.Unlock()
 
-	_, err = conn.Write(query)
+	// The writes do not hold the Mutex, so the responses are delivered while a write is blocked. A write
+	// is bounded by the deadline of the context and the ReadTimeout, the connection is closed after a
+	// timed out write since the frame might be written partially.
+	c.WriteMutex.Lock()
+	err = conn.SetWriteDeadline(c.WriteDeadline(ctx))
+	if err == nil {
+		_, err = conn.Write(request)
+	}
+	c.WriteMutex.Unlock()
+	if err != nil {
+		c.Mutex.Lock()
+		c.closeConnection(conn, err)
+		c.Mutex.Unlock()
+	}
+
+	var timeouts <-chan time.Time
+	if c.ReadTimeout > 0 {
+		timer := time.NewTimer(c.ReadTimeout)
+		defer timer.Stop()
+		timeouts = timer.C
+	}
+	select {
+	case response := <-responses:
+		return response.Payload, response.Err
+	case <-ctx.Done():
+		// The late response of the request is dropped by ReadResponses
+		c.Mutex.Lock()
+		delete(c.Pending, id)
+		c.Mutex.Unlock()
+		return nil, ctx.Err()
+	case <-timeouts:
+		c.Mutex.Lock()
+		if _, pending := c.Pending[id]; pending {
+			c.closeConnection(conn, ErrReadTimeout)
+		}
+		c.Mutex.Unlock()
+	}
+	response := <-responses
+	return response.Payload, response.Err
+}
+
+// WriteDeadline returns the earlier of the deadline of the context and the ReadTimeout, or the zero
+// time if there is neither
+func (c *TCPClient) WriteDeadline(ctx context.Context) time.Time {
+	var deadline time.Time
+	if c.ReadTimeout > 0 {
+		deadline = time.Now().Add(c.ReadTimeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// DeadlineTimeout returns the milliseconds left until the deadline of the context, or 0 if the context
+// has no deadline
+func DeadlineTimeout(ctx context.Context) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	if remaining > math.MaxUint32*time.Millisecond {
+		return math.MaxUint32, nil
+	}
+	return uint32((remaining + time.Millisecond - 1) / time.Millisecond), nil
+}
+
+// Connect returns the connection to the server and dials it if there is none, the caller must hold the Mutex
+func (c *TCPClient) Connect(ctx context.Context) (net.Conn, error) {
+	if c.Connection != nil {
+		return c.Connection, nil
+	}
+	dialer := net.Dialer{Timeout: c.DialTimeout}
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address())
 	if err != nil {
 		return nil, err
 	}
-	defer func(conn *net.TCPConn) {
-		if err := conn.Close(); err != nil {
-			fmt.Printf("Error closing TCP connection: %s\n", err.Error())
+	c.Connection = conn
+	go c.ReadResponses(conn)
+	return conn, nil
+}
+
+// ReadResponses delivers the responses of the connection until it fails, the pending requests fail
+// along with the connection
+func (c *TCPClient) ReadResponses(conn net.Conn) {
+	for {
+		frame, err := ReadResponse(conn)
+		if err == nil && frame.Id == 0 {
+			err = errors.New(string(frame.Payload))
+		}
+		c.Mutex.Lock()
+		if err != nil {
+			c.closeConnection(conn, err)
+			c.Mutex.Unlock()
+			return
+		}
+		responses, exists := c.Pending[frame.Id]
+		delete(c.Pending, frame.Id)
+		c.Mutex.Unlock()
+		if exists {
+			payload, err := frame.Result()
+			responses <- Response{Payload: payload, Err: err}
 		}
-	}(conn)
+	}
+}
+
+// closeConnection closes the connection and fails its pending requests, the caller must hold the Mutex
+func (c *TCPClient) closeConnection(conn net.Conn, err error) {
+	if c.Connection != conn {
+		return
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = ErrConnectionClosed
+	}
+	_ = conn.Close()
+	c.Connection = nil
+	for id, responses := range c.Pending {
+		responses <- Response{Err: err}
+		delete(c.Pending, id)
+	}
+}
+
+func (c *TCPClient) Connected() bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.Connection != nil
+}
 
-	var buffer bytes.Buffer
-	if _, err := io.Copy(&buffer, conn); err != nil {
+// Close closes the connection, the requests waiting for their responses fail with ErrConnectionClosed
+func (c *TCPClient) Close() error {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if c.Connection != nil {
+		c.closeConnection(c.Connection, ErrConnectionClosed)
+	}
+	return nil
+}
+
+// ReadResponse reads a response frame, the frame might arrive in several reads of the connection
+func ReadResponse(reader io.Reader) (*ResponseFrame, error) {
+	header := make([]byte, ResponseHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := BytesToUint32(header[5:ResponseHeaderSize])
+	if length > MaxResponseSize {
+		return nil, fmt.Errorf("%w: %d bytes, the maximum is %d", ErrFrameTooLarge, length, MaxResponseSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return &ResponseFrame{
+		Id:      BytesToUint32(header[0:4]),
+		Status:  header[4],
+		Payload: payload,
+	}, nil
+}
+
+// Result returns the payload of the response, or the ResponseError of an error response
+func (f *ResponseFrame) Result() ([]byte, error) {
+	if f.Status != StatusOK {
+		return nil, &ResponseError{Message: string(f.Payload)}
+	}
+	return f.Payload, nil
+}
+
+func (c *TCPClient) Query(s string, page uint32) (*engine.SearchResults, error) {
+	return c.QueryContext(context.Background(), s, page)
+}
+
+// QueryContext sends the deadline of the context along with the query, so the server stops searching
+// once the deadline passes and responds with the partial results
+func (c *TCPClient) QueryContext(ctx context.Context, s string, page uint32) (*engine.SearchResults, error) {
+	response, err := c.SendContext(ctx, c.PrepareQuery(s, page))
+	if err != nil {
 		return nil, err
 	}
 	var searchResults engine.SearchResults
-	if err = json.Unmarshal(buffer.Bytes(), &searchResults); err != nil {
+	if err = json.Unmarshal(response, &searchResults); err != nil {
 		return nil, err
 	}
 
 	return &searchResults, nil
 }
+
+func (c *TCPClient) Complete(prefix string, limit uint32) (*engine.CompletionResults, error) {
+	return c.CompleteContext(context.Background(), prefix, limit)
+}
+
+func (c *TCPClient) CompleteContext(ctx context.Context, prefix string, limit uint32) (*engine.CompletionResults, error) {
+	response, err := c.SendContext(ctx, c.PrepareRequest(COMPLETE, prefix, limit))
+	if err != nil {
+		return nil, err
+	}
+	var completionResults engine.CompletionResults
+	if err = json.Unmarshal(response, &completionResults); err != nil {
+		return nil, err
+	}
+
+	return &completionResults, nil
+}
+
+func (c *TCPClient) AddDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error) {
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendDocument(c.PrepareRequest(ADD, string(payload), 0))
+}
+
+func (c *TCPClient) UpdateDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error) {
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendDocument(c.PrepareRequest(UPDATE, string(payload), 0))
+}
+
+func (c *TCPClient) DeleteDocument(url string) (*engine.DocumentResult, error) {
+	return c.SendDocument(c.PrepareRequest(DELETE, url, 0))
+}
+
+func (c *TCPClient) SendDocument(request []byte) (*engine.DocumentResult, error) {
+	response, err := c.Send(request)
+	if err != nil {
+		return nil, err
+	}
+	var documentResult engine.DocumentResult
+	if err = json.Unmarshal(response, &documentResult); err != nil {
+		return nil, err
+	}
+
+	return &documentResult, nil
+}
+
+// Reload asks the server to rebuild its indexes in the background, the latest dumps are downloaded
+// again if refresh is set
+func (c *TCPClient) Reload(refresh bool) (string, error) {
+	page := uint32(0)
+	if refresh {
+		page = 1
+	}
+	response, err := c.Send(c.PrepareRequest(RELOAD, "", page))
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
@@ -0,0 +1,47 @@
+package tcpclient
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendWriteDeadline(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		readTimeout time.Duration
+	}{
+		{"context deadline", 50 * time.Millisecond, 0},
+		{"read timeout", time.Hour, 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		// The server never reads the requests, so the write is blocked
+		conn, server := net.Pipe()
+		client := NewTCPClient("127.0.0.1", "0", "tcp")
+		client.ReadTimeout = test.readTimeout
+		client.Connection = conn
+		go client.ReadResponses(conn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+		sent := make(chan error, 1)
+		go func() {
+			_, err := client.SendContext(ctx, client.PrepareQuery("alpha", 1))
+			sent <- err
+		}()
+		select {
+		case err := <-sent:
+			if err == nil {
+				t.Errorf("%s: expected the write to time out", test.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the write was not bounded", test.name)
+		}
+		if client.Connected() {
+			t.Errorf("%s: expected the connection to be closed after the timed out write", test.name)
+		}
+		cancel()
+		_ = server.Close()
+	}
+}
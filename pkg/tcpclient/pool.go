@@ -0,0 +1,268 @@
+package tcpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xkmsoft/wikisearcher/pkg/engine"
+)
+
+// PoolOptions configures the connections of the pool. The idempotent requests failing on the connection
+// are retried up to Retries times, waiting Backoff before the first retry and doubling it up to MaxBackoff.
+// An idle connection is probed before it is reused if it has been idle longer than HealthCheckInterval.
+type PoolOptions struct {
+	MaxIdle             int
+	MaxOpen             int
+	DialTimeout         time.Duration
+	ReadTimeout         time.Duration
+	Retries             int
+	Backoff             time.Duration
+	MaxBackoff          time.Duration
+	HealthCheckInterval time.Duration
+}
+
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{
+		MaxIdle:             4,
+		MaxOpen:             16,
+		DialTimeout:         2 * time.Second,
+		ReadTimeout:         10 * time.Second,
+		Retries:             3,
+		Backoff:             50 * time.Millisecond,
+		MaxBackoff:          time.Second,
+		HealthCheckInterval: 30 * time.Second,
+	}
+}
+
+var ErrPoolClosed = errors.New("connection pool closed")
+
+type PoolInterface interface {
+	Query(s string, page uint32) (*engine.SearchResults, error)
+	Complete(prefix string, limit uint32) (*engine.CompletionResults, error)
+	QueryContext(ctx context.Context, s string, page uint32) (*engine.SearchResults, error)
+	CompleteContext(ctx context.Context, prefix string, limit uint32) (*engine.CompletionResults, error)
+	AddDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error)
+	UpdateDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error)
+	DeleteDocument(url string) (*engine.DocumentResult, error)
+	Reload(refresh bool) (string, error)
+	Do(ctx context.Context, idempotent bool, request func(client *TCPClient) error) error
+	Get(ctx context.Context) (*PooledClient, error)
+	Put(client *PooledClient, err error)
+	Close() error
+}
+
+// PooledClient is a connection of the pool, Used is the time it was returned to the pool
+type PooledClient struct {
+	*TCPClient
+	Used time.Time
+}
+
+// Pool lends its clients to one request at a time. Slots bounds the number of the open connections, and
+// the connections returned by the requests are kept in Idle up to MaxIdle.
+type Pool struct {
+	Ip      string
+	Port    string
+	Network string
+	Options PoolOptions
+	Idle    []*PooledClient
+	Slots   chan bool
+	Closed  bool
+	Mutex   sync.Mutex
+}
+
+func NewPool(ip string, port string, network string, options PoolOptions) *Pool {
+	if options.MaxOpen < 1 {
+		options.MaxOpen = 1
+	}
+	if options.MaxIdle > options.MaxOpen {
+		options.MaxIdle = options.MaxOpen
+	}
+	return &Pool{
+		Ip:      ip,
+		Port:    port,
+		Network: network,
+		Options: options,
+		Idle:    make([]*PooledClient, 0, options.MaxIdle),
+		Slots:   make(chan bool, options.MaxOpen),
+	}
+}
+
+// Get waits for a free slot until the context is done, and returns the most recently used healthy idle
+// client or a new client which dials on its first request. It returns ErrPoolClosed once the pool is closed.
+func (p *Pool) Get(ctx context.Context) (*PooledClient, error) {
+	select {
+	case p.Slots <- true:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		p.Mutex.Lock()
+		if p.Closed {
+			p.Mutex.Unlock()
+			<-p.Slots
+			return nil, ErrPoolClosed
+		}
+		if len(p.Idle) == 0 {
+			p.Mutex.Unlock()
+			break
+		}
+		client := p.Idle[len(p.Idle)-1]
+		p.Idle = p.Idle[:len(p.Idle)-1]
+		p.Mutex.Unlock()
+		if p.Healthy(client) {
+			return client, nil
+		}
+		_ = client.Close()
+	}
+	client := NewTCPClient(p.Ip, p.Port, p.Network)
+	client.DialTimeout = p.Options.DialTimeout
+	client.ReadTimeout = p.Options.ReadTimeout
+	return &PooledClient{TCPClient: client}, nil
+}
+
+// Healthy reports whether the connection of the idle client is still open, the connections idle for
+// longer than the HealthCheckInterval are probed with an empty completion
+func (p *Pool) Healthy(client *PooledClient) bool {
+	if !client.Connected() {
+		return false
+	}
+	if p.Options.HealthCheckInterval > 0 && time.Since(client.Used) > p.Options.HealthCheckInterval {
+		if _, err := client.Complete("", 0); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Put returns the client to the pool and frees its slot. The client is closed if the request failed on
+// the connection or if there are MaxIdle idle clients already.
+func (p *Pool) Put(client *PooledClient, err error) {
+	defer func() { <-p.Slots }()
+	if err != nil && !ConnectionHealthy(err) || !client.Connected() {
+		_ = client.Close()
+		return
+	}
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	if p.Closed || len(p.Idle) >= p.Options.MaxIdle {
+		_ = client.Close()
+		return
+	}
+	client.Used = time.Now()
+	p.Idle = append(p.Idle, client)
+}
+
+// ConnectionHealthy reports whether the connection is still usable after the error of a request, which
+// is the case for the error responses of the server and for the requests abandoned by their contexts
+func ConnectionHealthy(err error) bool {
+	var responseError *ResponseError
+	return errors.As(err, &responseError) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Do runs the request with a client of the pool. The idempotent requests are retried with an exponential
+// backoff if they fail on the connection until the context is done, the error responses of the server
+// are not retried.
+func (p *Pool) Do(ctx context.Context, idempotent bool, request func(client *TCPClient) error) error {
+	backoff := p.Options.Backoff
+	for attempt := 0; ; attempt++ {
+		client, err := p.Get(ctx)
+		if err != nil {
+			return err
+		}
+		err = request(client.TCPClient)
+		p.Put(client, err)
+
+		if err == nil || ConnectionHealthy(err) || !idempotent || attempt >= p.Options.Retries {
+			return err
+		}
+		fmt.Printf("Retrying the request to %s in %v: %s\n", client.Address(), backoff, err.Error())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		if backoff *= 2; p.Options.MaxBackoff > 0 && backoff > p.Options.MaxBackoff {
+			backoff = p.Options.MaxBackoff
+		}
+	}
+}
+
+func (p *Pool) Query(s string, page uint32) (*engine.SearchResults, error) {
+	return p.QueryContext(context.Background(), s, page)
+}
+
+func (p *Pool) QueryContext(ctx context.Context, s string, page uint32) (*engine.SearchResults, error) {
+	var searchResults *engine.SearchResults
+	err := p.Do(ctx, true, func(client *TCPClient) (err error) {
+		searchResults, err = client.QueryContext(ctx, s, page)
+		return err
+	})
+	return searchResults, err
+}
+
+func (p *Pool) Complete(prefix string, limit uint32) (*engine.CompletionResults, error) {
+	return p.CompleteContext(context.Background(), prefix, limit)
+}
+
+func (p *Pool) CompleteContext(ctx context.Context, prefix string, limit uint32) (*engine.CompletionResults, error) {
+	var completionResults *engine.CompletionResults
+	err := p.Do(ctx, true, func(client *TCPClient) (err error) {
+		completionResults, err = client.CompleteContext(ctx, prefix, limit)
+		return err
+	})
+	return completionResults, err
+}
+
+func (p *Pool) AddDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error) {
+	var documentResult *engine.DocumentResult
+	err := p.Do(context.Background(), false, func(client *TCPClient) (err error) {
+		documentResult, err = client.AddDocument(doc)
+		return err
+	})
+	return documentResult, err
+}
+
+func (p *Pool) UpdateDocument(doc engine.WikiXMLDoc) (*engine.DocumentResult, error) {
+	var documentResult *engine.DocumentResult
+	err := p.Do(context.Background(), false, func(client *TCPClient) (err error) {
+		documentResult, err = client.UpdateDocument(doc)
+		return err
+	})
+	return documentResult, err
+}
+
+func (p *Pool) DeleteDocument(url string) (*engine.DocumentResult, error) {
+	var documentResult *engine.DocumentResult
+	err := p.Do(context.Background(), false, func(client *TCPClient) (err error) {
+		documentResult, err = client.DeleteDocument(url)
+		return err
+	})
+	return documentResult, err
+}
+
+func (p *Pool) Reload(refresh bool) (string, error) {
+	var response string
+	err := p.Do(context.Background(), false, func(client *TCPClient) (err error) {
+		response, err = client.Reload(refresh)
+		return err
+	})
+	return response, err
+}
+
+// Close closes the idle clients, the clients in use are closed when they are returned and the requests
+// made afterwards fail with ErrPoolClosed
+func (p *Pool) Close() error {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	for _, client := range p.Idle {
+		_ = client.Close()
+	}
+	p.Idle = p.Idle[:0]
+	p.Closed = true
+	return nil
+}
@@ -0,0 +1,342 @@
+package tcpclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xkmsoft/wikisearcher/pkg/engine"
+)
+
+// StubHandler returns the status and the payload of the response to the request received on the n-th
+// accepted connection, the connection is closed without a response if ok is false
+type StubHandler func(n int32, command byte, payload []byte) (status byte, response []byte, ok bool)
+
+// StubServer answers the requests of the pool on a random port of the loopback address
+type StubServer struct {
+	Listener net.Listener
+	Handler  StubHandler
+	Accepted int32
+	Commands []byte
+	Mutex    sync.Mutex
+}
+
+func NewStubServer(t *testing.T, handler StubHandler) *StubServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &StubServer{Listener: listener, Handler: handler}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.Serve(conn, atomic.AddInt32(&s.Accepted, 1))
+		}
+	}()
+	return s
+}
+
+func (s *StubServer) Serve(conn net.Conn, n int32) {
+	defer conn.Close()
+	for {
+		header := make([]byte, RequestHeaderSize)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		payload := make([]byte, BytesToUint32(header[14:18]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		s.Mutex.Lock()
+		s.Commands = append(s.Commands, header[1])
+		s.Mutex.Unlock()
+
+		status, response, ok := s.Handler(n, header[1], payload)
+		if !ok {
+			return
+		}
+		frame := append(header[2:6:6], status)
+		frame = append(frame, Uint32ToBytes(uint32(len(response)))...)
+		if _, err := conn.Write(append(frame, response...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *StubServer) Port() string {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return port
+}
+
+func (s *StubServer) ReceivedCommands() []byte {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return append([]byte(nil), s.Commands...)
+}
+
+// StubResponse answers the queries with a single result, the completions with no completions and the
+// document modifications with an error response
+func StubResponse(command byte) (byte, []byte) {
+	switch command {
+	case QUERY:
+		response, _ := json.Marshal(engine.SearchResults{NumberOfResults: 1})
+		return StatusOK, response
+	case COMPLETE:
+		response, _ := json.Marshal(engine.CompletionResults{})
+		return StatusOK, response
+	default:
+		return StatusError, []byte("document not found")
+	}
+}
+
+func TestPoolRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		broken     int32
+		idempotent bool
+		retries    int
+		failed     bool
+		accepted   int32
+		elapsed    time.Duration
+	}{
+		{"retried query", 1, true, 3, false, 2, 0},
+		{"exhausted retries", 100, true, 2, true, 3, 20*time.Millisecond + 40*time.Millisecond},
+		{"not idempotent", 1, false, 3, true, 1, 0},
+	}
+	for _, test := range tests {
+		test := test
+		// The first broken connections are closed without responding
+		s := NewStubServer(t, func(n int32, command byte, payload []byte) (byte, []byte, bool) {
+			status, response := StubResponse(command)
+			return status, response, n > test.broken
+		})
+		options := DefaultPoolOptions()
+		options.Retries = test.retries
+		options.Backoff = 20 * time.Millisecond
+		pool := NewPool("127.0.0.1", s.Port(), "tcp", options)
+
+		t0 := time.Now()
+		var err error
+		if test.idempotent {
+			_, err = pool.Query("alpha", 1)
+		} else {
+			_, err = pool.AddDocument(engine.WikiXMLDoc{Url: "https://en.wikipedia.org/wiki/Alpha"})
+		}
+		elapsed := time.Since(t0)
+		if (err != nil) != test.failed {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if accepted := atomic.LoadInt32(&s.Accepted); accepted != test.accepted {
+			t.Errorf("%s: expected %d connections, got %d", test.name, test.accepted, accepted)
+		}
+		if elapsed < test.elapsed {
+			t.Errorf("%s: expected a backoff of %v, retried in %v", test.name, test.elapsed, elapsed)
+		}
+		_ = pool.Close()
+	}
+}
+
+func TestPoolErrorResponses(t *testing.T) {
+	s := NewStubServer(t, func(n int32, command byte, payload []byte) (byte, []byte, bool) {
+		status, response := StubResponse(command)
+		return status, response, true
+	})
+	pool := NewPool("127.0.0.1", s.Port(), "tcp", DefaultPoolOptions())
+	defer pool.Close()
+
+	// The error responses are neither retried nor closing the connection
+	var responseError *ResponseError
+	if _, err := pool.DeleteDocument("https://en.wikipedia.org/wiki/Omega"); !errors.As(err, &responseError) {
+		t.Fatalf("expected an error response, got %v", err)
+	}
+	if commands := s.ReceivedCommands(); len(commands) != 1 || len(pool.Idle) != 1 {
+		t.Fatalf("expected a single request on a kept connection, got %v with %d idle", commands, len(pool.Idle))
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	release := make(chan bool)
+	running := int32(0)
+	s := NewStubServer(t, func(n int32, command byte, payload []byte) (byte, []byte, bool) {
+		atomic.AddInt32(&running, 1)
+		<-release
+		status, response := StubResponse(command)
+		return status, response, true
+	})
+	options := DefaultPoolOptions()
+	options.MaxOpen = 2
+	options.MaxIdle = 2
+	pool := NewPool("127.0.0.1", s.Port(), "tcp", options)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for n := 0; n < 3; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.Query("alpha", 1)
+			errs <- err
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&running) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&running); n != 2 {
+		t.Fatalf("expected 2 running requests, got %d", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the pool to be exhausted, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The third request reuses one of the connections
+	if accepted := atomic.LoadInt32(&s.Accepted); accepted != 2 || len(pool.Idle) != 2 {
+		t.Fatalf("expected 2 idle connections, accepted %d with %d idle", accepted, len(pool.Idle))
+	}
+}
+
+func TestPoolIdleConnections(t *testing.T) {
+	s := NewStubServer(t, func(n int32, command byte, payload []byte) (byte, []byte, bool) {
+		status, response := StubResponse(command)
+		return status, response, true
+	})
+	options := DefaultPoolOptions()
+	options.MaxIdle = 1
+	pool := NewPool("127.0.0.1", s.Port(), "tcp", options)
+	defer pool.Close()
+
+	for n := 0; n < 3; n++ {
+		if _, err := pool.Query("alpha", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if accepted := atomic.LoadInt32(&s.Accepted); accepted != 1 {
+		t.Fatalf("expected the connection to be reused, accepted %d", accepted)
+	}
+
+	// The connections returned beyond MaxIdle are closed
+	first, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Query("alpha", 1); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(first, nil)
+	pool.Put(second, nil)
+	if len(pool.Idle) != 1 || second.Connected() {
+		t.Fatalf("expected a single idle connection, got %d", len(pool.Idle))
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		healthy  bool
+		accepted int32
+	}{
+		{"healthy connection", true, 1},
+		{"stalled connection", false, 2},
+	}
+	for _, test := range tests {
+		test := test
+		// The probe of the first connection fails if it is not healthy
+		s := NewStubServer(t, func(n int32, command byte, payload []byte) (byte, []byte, bool) {
+			status, response := StubResponse(command)
+			return status, response, command != COMPLETE || n > 1 || test.healthy
+		})
+		options := DefaultPoolOptions()
+		options.HealthCheckInterval = time.Millisecond
+		pool := NewPool("127.0.0.1", s.Port(), "tcp", options)
+
+		if _, err := pool.Query("alpha", 1); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if _, err := pool.Query("alpha", 1); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if commands := s.ReceivedCommands(); len(commands) != 3 || commands[1] != COMPLETE {
+			t.Errorf("%s: expected the idle connection to be probed, got %v", test.name, commands)
+		}
+		if accepted := atomic.LoadInt32(&s.Accepted); accepted != test.accepted {
+			t.Errorf("%s: expected %d connections, got %d", test.name, test.accepted, accepted)
+		}
+		_ = pool.Close()
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	s := NewStubServer(t, func(n int32, command byte, payload []byte) (byte, []byte, bool) {
+		status, response := StubResponse(command)
+		return status, response, true
+	})
+	options := DefaultPoolOptions()
+	options.MaxOpen = 1
+	pool := NewPool("127.0.0.1", s.Port(), "tcp", options)
+	if _, err := pool.Query("alpha", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		request func() error
+	}{
+		{"query", func() error {
+			_, err := pool.Query("alpha", 1)
+			return err
+		}},
+		{"completion", func() error {
+			_, err := pool.Complete("al", 5)
+			return err
+		}},
+		{"deletion", func() error {
+			_, err := pool.DeleteDocument("https://en.wikipedia.org/wiki/Alpha")
+			return err
+		}},
+		{"get", func() error {
+			_, err := pool.Get(context.Background())
+			return err
+		}},
+	}
+	for _, test := range tests {
+		if err := test.request(); !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("%s: expected ErrPoolClosed, got %v", test.name, err)
+		}
+	}
+	if accepted := atomic.LoadInt32(&s.Accepted); accepted != 1 {
+		t.Errorf("expected no connections after closing the pool, accepted %d", accepted)
+	}
+	// The slots of the failed requests are freed
+	if len(pool.Slots) != 0 {
+		t.Errorf("expected no slots in use, got %d", len(pool.Slots))
+	}
+}
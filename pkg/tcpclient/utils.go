@@ -15,3 +15,7 @@ func Uint32ToBytes(a uint32) []byte {
 	binary.BigEndian.PutUint32(bs, a)
 	return bs
 }
+
+func BytesToUint32(bytes []byte) uint32 {
+	return binary.BigEndian.Uint32(bytes)
+}
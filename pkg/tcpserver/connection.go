@@ -0,0 +1,52 @@
+package tcpserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection is a persistent client connection. Mutex serializes the response frames of the pipelined
+// requests, Requests bounds the number of the requests handled at once and WaitGroup tracks them. The
+// Context of the requests is canceled once the connection is closed.
+type Connection struct {
+	Conn      net.Conn
+	Context   context.Context
+	Cancel    context.CancelFunc
+	Mutex     sync.Mutex
+	Requests  chan bool
+	WaitGroup sync.WaitGroup
+}
+
+func NewConnection(conn net.Conn) *Connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Connection{
+		Conn:     conn,
+		Context:  ctx,
+		Cancel:   cancel,
+		Requests: make(chan bool, MaxPipelinedRequests),
+	}
+}
+
+// WriteResponse writes the response frame within the WriteTimeout, so a client which does not read its
+// responses can not hold the handler of the request forever
+func (c *Connection) WriteResponse(id uint32, status byte, payload []byte) error {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout)); err != nil {
+		return err
+	}
+	return WriteFrame(c.Conn, id, status, payload)
+}
+
+// Close cancels the requests being handled, since the client has stopped sending requests, waits for
+// their responses and closes the connection
+func (c *Connection) Close() {
+	c.Cancel()
+	c.WaitGroup.Wait()
+	if err := c.Conn.Close(); err != nil {
+		fmt.Printf("Error closing connection: %s\n", err.Error())
+	}
+}
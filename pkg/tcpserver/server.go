@@ -1,42 +1,113 @@
 package tcpserver
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/xkmsoft/wikisearcher/pkg/engine"
 )
 
+// The page field of the request carries the maximum number of completions for COMPLETE. The payload of
+// ADD and UPDATE is the JSON encoded document, and the payload of DELETE is the url of the document.
+// RELOAD is an admin command accepted from the loopback addresses, a non-zero page field downloads the
+// latest dumps again.
 const (
-	QUERY = byte(0)
+	QUERY    = byte(0)
+	COMPLETE = byte(1)
+	ADD      = byte(2)
+	UPDATE   = byte(3)
+	DELETE   = byte(4)
+	RELOAD   = byte(5)
 )
 
 const (
-	DataDirectory      = "data"
-	BaseIndexes        = "indexes%s.json"
-	BaseData           = "data%s.json"
-	BaseFile           = "enwiki-latest-abstract%s.%s"
-	BaseURL            = "https://dumps.wikimedia.org/enwiki/latest/enwiki-latest-abstract%s.xml.gz"
-	XMLExtension       = "xml"
-	GZExtension        = "xml.gz"
-	AbstractFilesCount = 28
+	DataDirectory             = "data"
+	BaseIndexes               = "indexes%s.idx"
+	BaseJSONIndexes           = "indexes%s.json"
+	BaseData                  = "data%s.json"
+	BaseManifest              = "snapshot%s.json"
+	BaseFile                  = "enwiki-latest-abstract%s.%s"
+	BaseURL                   = "https://dumps.wikimedia.org/enwiki/latest/enwiki-latest-abstract%s.xml.gz"
+	XMLExtension              = "xml"
+	GZExtension               = "xml.gz"
+	SegmentsDirectory         = "segments"
+	ReloadDirectory           = "reload"
+	PreviousSegmentsDirectory = "segments.previous"
+	AbstractFilesCount        = 28
+)
+
+// The requests and the responses are framed with their lengths, so a request is read completely even
+// if it arrives in several reads, and a response is complete without closing the connection. The
+// integers are big endian, and the payload of an error response is the message of the error. The
+// connections are persistent and the requests are pipelined, so a response carries the id of its
+// request. The errors of the connection, e.g. an invalid frame, are responded with the id 0. The
+// timeout is the number of milliseconds the client waits for the response (0 waits forever), a query
+// is stopped after 90% of its timeout so its partial results reach the client in time.
+//
+//	request   version byte | command byte | id uint32 | page uint32 | timeout uint32 | payload length uint32 | payload
+//	response  id uint32 | status byte | payload length uint32 | payload
+const (
+	ProtocolVersion      = byte(3)
+	RequestHeaderSize    = 18
+	ResponseHeaderSize   = 9
+	MaxRequestSize       = 1024 * 1024 * 1 // 1MB
+	MaxPipelinedRequests = 64
+	IdleTimeout          = 5 * time.Minute
+	WriteTimeout         = 10 * time.Second
+	StatusOK             = byte(0)
+	StatusError          = byte(1)
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame exceeds the maximum length")
+	ErrServerClosed  = errors.New("server closed")
 )
 
 type ServerInterface interface {
 	Address() string
 	Signature() string
 	InitializeServer() error
-	HandleRequest(connection net.Conn)
-	HandleResponse(response string, connection net.Conn)
-	ParseQuery(query []byte) (*QueryStruct, error)
+	LoadIndexes(indexer *engine.Indexer, files []*AbstractStruct) error
+	LoadOrCreateIndexes(indexer *engine.Indexer, abstracts *AbstractStruct) error
+	LoadDumps(indexer *engine.Indexer, indexDump string, dataDump string) error
+	RemoveSnapshot(abstracts *AbstractStruct) error
+	LoadIndexDump(indexer *engine.Indexer, path string) error
+	IndexDumpPath(indexer *engine.Indexer, abstracts *AbstractStruct) string
+	CurrentIndexer() *engine.Indexer
+	Reload(refresh bool) error
+	IsReloading() bool
+	OpenSegmentStore(indexer *engine.Indexer) (*engine.SegmentStore, error)
+	StagedAbstractStructs(directory string) []*AbstractStruct
+	ReplaceAbstractFiles(staged []*AbstractStruct) error
+	SwapIndexer(indexer *engine.Indexer, staged []*AbstractStruct) (*engine.Indexer, error)
+	HandleSignals()
+	Shutdown(ctx context.Context) error
+	Quitting() bool
+	AddConnection(connection *Connection) bool
+	RemoveConnection(connection *Connection)
+	ExtendReadDeadline(connection *Connection) error
+	HandleConnection(connection net.Conn)
+	HandleRequest(queryStruct *QueryStruct, connection *Connection)
+	BuildResponse(ctx context.Context, queryStruct *QueryStruct) (string, error)
+	ReadDocument(queryStruct *QueryStruct) (engine.WikiXMLDoc, error)
+	HandleReload(queryStruct *QueryStruct, connection *Connection)
+	HandleResponse(queryStruct *QueryStruct, response string, connection *Connection)
+	HandleError(queryStruct *QueryStruct, err error, connection *Connection)
+	ParseQuery(reader io.Reader) (*QueryStruct, error)
 	AcceptConnections() error
-	GetAbstractStruct() *AbstractStruct
+	GetAbstractStructs() []*AbstractStruct
 	InitializeDataDirectory() error
 }
 
@@ -45,52 +116,90 @@ type AbstractStruct struct {
 	GZFileName  string
 	DataDump    string
 	IndexDump   string
+	JSONDump    string
+	Manifest    string
 	URL         string
 }
 
+// Server serves a single index built from the abstract files of the FileIndexes. The documents of
+// every abstract file are shifted by the engine.DumpBase of the file, so their indexes are unique.
+// The requests hold the Mutex for reading while they use the Indexer, so a reload can swap the
+// Indexer and close the previous one once the requests using it are done. If Segments is set, the
+// documents modified on the live index are persisted by the Store into the segments directory.
+// QuitSignal is closed by Shutdown, and the open Connections are tracked by the ConnectionGroup under
+// the ConnectionMutex, so Shutdown can wait for them.
 type Server struct {
-	Host       string
-	Port       string
-	Network    string
-	Indexer    *engine.Indexer
-	QuitSignal bool
-	Abstracts  []*AbstractStruct
-	FileIndex  int
-	CleanFlag  bool
+	Host            string
+	Port            string
+	Network         string
+	Indexer         *engine.Indexer
+	QuitSignal      chan bool
+	Listener        net.Listener
+	Connections     map[*Connection]bool
+	ConnectionGroup sync.WaitGroup
+	ConnectionMutex sync.Mutex
+	Abstracts       []*AbstractStruct
+	FileIndexes     []int
+	CleanFlag       bool
+	ExportJSON      bool
+	MemoryMap       bool
+	Segments        bool
+	Store           *engine.SegmentStore
+	Reloading       bool
+	Mutex           sync.RWMutex
+	ReloadMutex     sync.Mutex
 }
 
+// QueryStruct is a parsed request, the zero deadline means the request has no timeout
 type QueryStruct struct {
-	command byte
-	page    uint32
-	phrase  string
+	id       uint32
+	command  byte
+	page     uint32
+	deadline time.Time
+	phrase   string
+}
+
+// NewAbstractStruct returns the files of the i-th abstract file within the directory
+func NewAbstractStruct(directory string, i int) *AbstractStruct {
+	var index string
+	if i == 0 {
+		index = ""
+	} else {
+		index = strconv.Itoa(i)
+	}
+	return &AbstractStruct{
+		XMLFileName: filepath.Join(directory, fmt.Sprintf(BaseFile, index, XMLExtension)),
+		GZFileName:  filepath.Join(directory, fmt.Sprintf(BaseFile, index, GZExtension)),
+		DataDump:    filepath.Join(directory, fmt.Sprintf(BaseData, index)),
+		IndexDump:   filepath.Join(directory, fmt.Sprintf(BaseIndexes, index)),
+		JSONDump:    filepath.Join(directory, fmt.Sprintf(BaseJSONIndexes, index)),
+		Manifest:    filepath.Join(directory, fmt.Sprintf(BaseManifest, index)),
+		URL:         fmt.Sprintf(BaseURL, index),
+	}
+}
+
+// Files returns the files of the abstract file, the manifest is the last since it verifies the dumps
+func (a *AbstractStruct) Files() []string {
+	return []string{a.GZFileName, a.XMLFileName, a.IndexDump, a.DataDump, a.JSONDump, a.Manifest}
 }
 
-func NewServer(host string, port string, network string, index int, clean bool) *Server {
+func NewServer(host string, port string, network string, indexes []int, clean bool) *Server {
 	abstracts := make([]*AbstractStruct, AbstractFilesCount)
 	for i := 0; i < AbstractFilesCount; i++ {
-		var index string
-		if i == 0 {
-			index = ""
-		} else {
-			index = strconv.Itoa(i)
-		}
-		abstracts[i] = &AbstractStruct{
-			XMLFileName: filepath.Join(DataDirectory, fmt.Sprintf(BaseFile, index, XMLExtension)),
-			GZFileName:  filepath.Join(DataDirectory, fmt.Sprintf(BaseFile, index, GZExtension)),
-			DataDump:    filepath.Join(DataDirectory, fmt.Sprintf(BaseData, index)),
-			IndexDump:   filepath.Join(DataDirectory, fmt.Sprintf(BaseIndexes, index)),
-			URL:         fmt.Sprintf(BaseURL, index),
-		}
+		abstracts[i] = NewAbstractStruct(DataDirectory, i)
 	}
 	return &Server{
-		Host:       host,
-		Port:       port,
-		Network:    network,
-		Indexer:    engine.NewIndexer(),
-		QuitSignal: false,
-		Abstracts:  abstracts,
-		FileIndex:  index,
-		CleanFlag:  clean,
+		Host:        host,
+		Port:        port,
+		Network:     network,
+		Indexer:     engine.NewIndexer(),
+		QuitSignal:  make(chan bool),
+		Connections: map[*Connection]bool{},
+		Abstracts:   abstracts,
+		FileIndexes: indexes,
+		CleanFlag:   clean,
+		MemoryMap:   true,
+		Segments:    true,
 	}
 }
 
@@ -113,12 +222,21 @@ func (s *Server) InitializeDataDirectory() error {
 				}
 			}
 		}
+		for _, directory := range []string{SegmentsDirectory, PreviousSegmentsDirectory, ReloadDirectory} {
+			if err := os.RemoveAll(filepath.Join(DataDirectory, directory)); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func (s *Server) GetAbstractStruct() *AbstractStruct {
-	return s.Abstracts[s.FileIndex]
+func (s *Server) GetAbstractStructs() []*AbstractStruct {
+	abstracts := make([]*AbstractStruct, 0, len(s.FileIndexes))
+	for _, index := range s.FileIndexes {
+		abstracts = append(abstracts, s.Abstracts[index])
+	}
+	return abstracts
 }
 
 func (s *Server) Address() string {
@@ -140,146 +258,566 @@ func (s *Server) InitializeServer() error {
 	if err := s.InitializeDataDirectory(); err != nil {
 		return err
 	}
+	if err := s.LoadIndexes(s.Indexer, s.GetAbstractStructs()); err != nil {
+		return err
+	}
+	store, err := s.OpenSegmentStore(s.Indexer)
+	if err != nil {
+		return err
+	}
+	s.Store = store
+	return nil
+}
 
-	abstracts := s.GetAbstractStruct()
-
-	if s.Indexer.IsFileExists(abstracts.IndexDump) && s.Indexer.IsFileExists(abstracts.DataDump) {
-		// Loading concurrently the index and data dump files
-		workers := 2
-		done := make(chan bool)
-		errs := make(chan error)
+// OpenSegmentStore opens the segments of the live index on the indexer and starts flushing and merging
+// them in the background, nil is returned if Segments is not set
+func (s *Server) OpenSegmentStore(indexer *engine.Indexer) (*engine.SegmentStore, error) {
+	if !s.Segments {
+		return nil, nil
+	}
+	store, err := engine.OpenSegmentStore(filepath.Join(DataDirectory, SegmentsDirectory), indexer)
+	if err != nil {
+		return nil, err
+	}
+	store.Start(engine.FlushInterval)
+	return store, nil
+}
 
-		go func() {
-			if err := s.Indexer.LoadIndexDump(abstracts.IndexDump); err != nil {
-				errs <- err
+// LoadIndexes loads the abstract files into the indexer. Every abstract file is loaded by its own
+// indexer, since the dumps of the files are saved with document indexes starting from 0, and then
+// merged into the given indexer. The completions and the BK-tree are built once all the files are merged.
+func (s *Server) LoadIndexes(indexer *engine.Indexer, files []*AbstractStruct) error {
+	for n, abstracts := range files {
+		fileIndexer := indexer.NewEmptyIndexer()
+		err := s.LoadOrCreateIndexes(fileIndexer, abstracts)
+		if errors.Is(err, engine.ErrInvalidSnapshot) {
+			// The dumps are removed, so the abstracts are indexed again from the XML file
+			fmt.Printf("Indexing %s again: %s\n", abstracts.XMLFileName, err.Error())
+			_ = fileIndexer.Close()
+			if err = s.RemoveSnapshot(abstracts); err == nil {
+				fileIndexer = indexer.NewEmptyIndexer()
+				err = s.LoadOrCreateIndexes(fileIndexer, abstracts)
 			}
-			done <- true
-		}()
-
-		go func() {
-			if err := s.Indexer.LoadDataDump(abstracts.DataDump); err != nil {
-				errs <- err
+		}
+		if err != nil {
+			return err
+		}
+		if s.ExportJSON {
+			if err := fileIndexer.SaveIndexDump(abstracts.JSONDump); err != nil {
+				return err
 			}
-			done <- true
-		}()
+		}
+		if err := indexer.Merge(fileIndexer, engine.DumpBase(s.FileIndexes[n])); err != nil {
+			return err
+		}
+	}
+	indexer.BuildCompletions()
+	indexer.BuildFuzzyTree()
+	fmt.Printf("There are %d documents in %d abstract files\n", indexer.NumberOfDocuments(), len(s.FileIndexes))
+	return nil
+}
 
-		count := 0
-		for {
-			select {
-			case err := <-errs:
-				return err
-			case <-done:
-				count++
-				if count == workers {
-					return nil
-				}
+// CurrentIndexer returns the indexer serving the requests, the callers using the indexer after a
+// reload has started must hold the Mutex for reading
+func (s *Server) CurrentIndexer() *engine.Indexer {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	return s.Indexer
+}
+
+func (s *Server) IsReloading() bool {
+	s.ReloadMutex.Lock()
+	defer s.ReloadMutex.Unlock()
+	return s.Reloading
+}
+
+// Reload builds a new indexer while the current one keeps serving the requests, and swaps them once
+// the new indexer is ready. If refresh is set, the latest dumps are downloaded and indexed into the
+// reload directory, and they replace the files of the abstracts only once they are loaded, so a failed
+// download keeps the current files. The documents modified on the live index are flushed and opened
+// on the new indexer, unless refresh is set since the documents of the new dumps differ.
+func (s *Server) Reload(refresh bool) error {
+	s.ReloadMutex.Lock()
+	if s.Reloading {
+		s.ReloadMutex.Unlock()
+		return errors.New("reload is already in progress")
+	}
+	s.Reloading = true
+	s.ReloadMutex.Unlock()
+	defer func() {
+		s.ReloadMutex.Lock()
+		s.Reloading = false
+		s.ReloadMutex.Unlock()
+	}()
+
+	fmt.Printf("Reloading the indexes on %s\n", s.Signature())
+	t0 := time.Now()
+	defer func(t0 time.Time) {
+		fmt.Printf("Reloading the indexes took %f seconds\n", time.Since(t0).Seconds())
+	}(t0)
+
+	files := s.GetAbstractStructs()
+	staging := filepath.Join(DataDirectory, ReloadDirectory)
+	if refresh {
+		if err := os.RemoveAll(staging); err != nil {
+			return err
+		}
+		if err := os.Mkdir(staging, 0755); err != nil {
+			return err
+		}
+		files = s.StagedAbstractStructs(staging)
+	}
+	indexer := s.CurrentIndexer().NewEmptyIndexer()
+	if err := s.LoadIndexes(indexer, files); err != nil {
+		_ = indexer.Close()
+		return err
+	}
+	var staged []*AbstractStruct
+	if refresh {
+		staged = files
+	}
+	previous, err := s.SwapIndexer(indexer, staged)
+	if err != nil {
+		_ = indexer.Close()
+		return err
+	}
+	if refresh {
+		if err := os.RemoveAll(staging); err != nil {
+			fmt.Printf("Removing the reload directory failed: %s\n", err.Error())
+		}
+	}
+	return previous.Close()
+}
+
+// SwapIndexer replaces the indexer and its segment store, and returns the previous indexer. Acquiring
+// the Mutex waits for the requests using the previous indexer, so the previous store has flushed all
+// the modifications before the new indexer opens the segments. If the dumps are staged, the segments
+// are moved aside for the new dumps and the staged files replace the current ones. The previous
+// indexer keeps serving with its segments and its write-ahead log if the swap fails.
+func (s *Server) SwapIndexer(indexer *engine.Indexer, staged []*AbstractStruct) (*engine.Indexer, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if s.Quitting() {
+		return nil, ErrServerClosed
+	}
+	if s.Store != nil {
+		if err := s.Store.Close(); err != nil {
+			s.Store.Start(engine.FlushInterval)
+			return nil, fmt.Errorf("flushing the segment store: %w", err)
+		}
+	}
+
+	segments := filepath.Join(DataDirectory, SegmentsDirectory)
+	previousSegments := filepath.Join(DataDirectory, PreviousSegmentsDirectory)
+	store, err := func() (*engine.SegmentStore, error) {
+		if staged != nil {
+			if err := os.RemoveAll(previousSegments); err != nil {
+				return nil, err
+			}
+			if err := os.Rename(segments, previousSegments); err != nil && !os.IsNotExist(err) {
+				return nil, err
 			}
 		}
-	} else {
-		if s.Indexer.IsFileExists(abstracts.XMLFileName) {
-			if err := s.Indexer.LoadWikimediaDump(abstracts.XMLFileName, true, abstracts.IndexDump, abstracts.DataDump); err != nil {
-				return err
+		store, err := s.OpenSegmentStore(indexer)
+		if err != nil || staged == nil {
+			return store, err
+		}
+		// The mapped dumps stay valid while they are renamed
+		if err := s.ReplaceAbstractFiles(staged); err != nil {
+			if store != nil {
+				_ = store.Close()
 			}
-		} else {
-			// Wiki XML dump does not exists
-			if !s.Indexer.IsFileExists(abstracts.GZFileName) {
-				// Phase 1: Download from the server
-				if err := s.Indexer.DownloadWikimediaDump(abstracts.GZFileName, abstracts.URL); err != nil {
-					return err
+			return nil, err
+		}
+		return store, nil
+	}()
+	if err != nil {
+		if staged != nil {
+			if e := os.RemoveAll(segments); e == nil {
+				e = os.Rename(previousSegments, segments)
+				if e != nil && !os.IsNotExist(e) {
+					fmt.Printf("Restoring the segments failed: %s\n", e.Error())
 				}
 			}
-			// Phase 2: Uncompress the file
-			if err := s.Indexer.UncompressWikimediaDump(abstracts.GZFileName); err != nil {
+		}
+		if s.Store != nil {
+			if e := s.Store.Resume(engine.FlushInterval); e != nil {
+				fmt.Printf("Reopening the write-ahead log failed, the modifications are not logged: %s\n", e.Error())
+			}
+		}
+		return nil, err
+	}
+	if staged != nil {
+		if s.Store != nil {
+			fmt.Printf("Dropped %d modifications of the live index, since the dumps are downloaded again\n", s.Store.NumberOfModifications())
+		}
+		if err := os.RemoveAll(previousSegments); err != nil {
+			fmt.Printf("Removing the previous segments failed: %s\n", err.Error())
+		}
+	}
+	previous := s.Indexer
+	s.Indexer = indexer
+	s.Store = store
+	return previous, nil
+}
+
+// StagedAbstractStructs returns the files of the abstracts within the directory of a reload
+func (s *Server) StagedAbstractStructs(directory string) []*AbstractStruct {
+	abstracts := make([]*AbstractStruct, 0, len(s.FileIndexes))
+	for _, index := range s.FileIndexes {
+		abstracts = append(abstracts, NewAbstractStruct(directory, index))
+	}
+	return abstracts
+}
+
+// ReplaceAbstractFiles renames the staged files of the abstracts over the current ones, and removes
+// the current files which have no staged counterparts, e.g. the JSON dump if it was not exported
+func (s *Server) ReplaceAbstractFiles(staged []*AbstractStruct) error {
+	for n, abstracts := range s.GetAbstractStructs() {
+		files, stagedFiles := abstracts.Files(), staged[n].Files()
+		for idx, path := range files {
+			err := os.Rename(stagedFiles[idx], path)
+			if os.IsNotExist(err) {
+				err = os.Remove(path)
+			}
+			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
-			// Phase 3: Load file and create indexes
-			if err := s.Indexer.LoadWikimediaDump(abstracts.XMLFileName, true, abstracts.IndexDump, abstracts.DataDump); err != nil {
+		}
+	}
+	return engine.SyncDirectory(DataDirectory)
+}
+
+// RemoveSnapshot removes the index and the data dumps of the abstracts along with their manifest
+func (s *Server) RemoveSnapshot(abstracts *AbstractStruct) error {
+	for _, path := range []string{abstracts.Manifest, abstracts.DataDump, abstracts.IndexDump, abstracts.JSONDump} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleSignals reloads the indexes with the latest dumps on SIGHUP
+func (s *Server) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := s.Reload(true); err != nil {
+				fmt.Printf("Reloading the indexes failed: %s\n", err.Error())
+			}
+		}
+	}()
+}
+
+// IndexDumpPath returns the binary index dump if it exists, and the legacy JSON index dump otherwise
+func (s *Server) IndexDumpPath(indexer *engine.Indexer, abstracts *AbstractStruct) string {
+	if !indexer.IsFileExists(abstracts.IndexDump) && indexer.IsFileExists(abstracts.JSONDump) {
+		return abstracts.JSONDump
+	}
+	return abstracts.IndexDump
+}
+
+// LoadIndexDump maps the binary index dumps if MemoryMap is set, and loads them into the memory otherwise
+func (s *Server) LoadIndexDump(indexer *engine.Indexer, path string) error {
+	if s.MemoryMap {
+		isBinary, err := engine.IsBinaryIndexDump(path)
+		if err != nil {
+			return err
+		}
+		if isBinary {
+			return indexer.OpenIndexDump(path)
+		}
+	}
+	return indexer.LoadIndexDump(path)
+}
+
+// LoadOrCreateIndexes loads the dumps of the abstracts if their manifest is verified, and indexes the
+// abstracts otherwise. The errors of the verification wrap engine.ErrInvalidSnapshot.
+func (s *Server) LoadOrCreateIndexes(indexer *engine.Indexer, abstracts *AbstractStruct) error {
+	indexDump := s.IndexDumpPath(indexer, abstracts)
+	if indexer.IsFileExists(indexDump) && indexer.IsFileExists(abstracts.DataDump) {
+		manifest, err := engine.LoadSnapshotManifest(abstracts.Manifest)
+		if err != nil {
+			return err
+		}
+		if !manifest.Contains(indexDump, abstracts.DataDump) {
+			return fmt.Errorf("%w: %s does not contain %s", engine.ErrInvalidSnapshot, abstracts.Manifest, indexDump)
+		}
+		// The sections of the binary index dump are verified while loading it
+		if err := s.LoadDumps(indexer, indexDump, abstracts.DataDump); err != nil {
+			return fmt.Errorf("%w: %s", engine.ErrInvalidSnapshot, err.Error())
+		}
+		return manifest.Verify(indexer)
+	}
+
+	if !indexer.IsFileExists(abstracts.XMLFileName) {
+		// Wiki XML dump does not exists
+		if !indexer.IsFileExists(abstracts.GZFileName) {
+			// Phase 1: Download from the server
+			if err := indexer.DownloadWikimediaDump(abstracts.GZFileName, abstracts.URL); err != nil {
 				return err
 			}
 		}
+		// Phase 2: Uncompress the file
+		if err := indexer.UncompressWikimediaDump(abstracts.GZFileName); err != nil {
+			return err
+		}
+	}
+	// Phase 3: Load file and create indexes, the manifest is written once both dumps are saved
+	if err := indexer.LoadWikimediaDump(abstracts.XMLFileName, true, abstracts.IndexDump, abstracts.DataDump); err != nil {
+		return err
+	}
+	return indexer.SaveSnapshotManifest(abstracts.Manifest, abstracts.IndexDump, abstracts.DataDump)
+}
+
+// LoadDumps loads the index and the data dumps concurrently
+func (s *Server) LoadDumps(indexer *engine.Indexer, indexDump string, dataDump string) error {
+	workers := 2
+	errs := make(chan error, workers)
+	go func() {
+		errs <- s.LoadIndexDump(indexer, indexDump)
+	}()
+	go func() {
+		errs <- indexer.LoadDataDump(dataDump)
+	}()
+	for n := 0; n < workers; n++ {
+		if err := <-errs; err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (s *Server) HandleRequest(connection net.Conn) {
-	buffer := make([]byte, 1024)
-	length, err := connection.Read(buffer)
-	if err != nil {
-		s.HandleResponse(fmt.Sprintf("Error reading connection: %s\n", err.Error()), connection)
+// HandleConnection reads the requests of the connection until the client closes it, it is idle for
+// IdleTimeout or the server shuts down. The requests are handled concurrently, at most
+// MaxPipelinedRequests at once, so their responses might be written out of order. The connection is
+// closed after an invalid frame, since the next frame can not be found.
+func (s *Server) HandleConnection(connection net.Conn) {
+	conn := NewConnection(connection)
+	if !s.AddConnection(conn) {
+		_ = connection.Close()
 		return
 	}
+	defer s.RemoveConnection(conn)
+	defer conn.Close()
+	for {
+		if err := s.ExtendReadDeadline(conn); err != nil {
+			if !errors.Is(err, ErrServerClosed) {
+				fmt.Printf("Error setting the deadline of the connection: %s\n", err.Error())
+			}
+			return
+		}
+		queryStruct, err := s.ParseQuery(connection)
+		if err != nil {
+			if s.Quitting() {
+				// The requests being handled are completed before the connection is closed
+				conn.WaitGroup.Wait()
+				return
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+				s.HandleError(&QueryStruct{}, fmt.Errorf("reading the request: %w", err), conn)
+			}
+			return
+		}
+		conn.Requests <- true
+		conn.WaitGroup.Add(1)
+		go func() {
+			defer func() {
+				<-conn.Requests
+				conn.WaitGroup.Done()
+			}()
+			s.HandleRequest(queryStruct, conn)
+		}()
+	}
+}
+
+// HandleRequest handles the request within the context of the connection, which is canceled along with
+// the connection, and the deadline of the request. The requests waiting past their deadlines are not
+// handled, since the client has given up on them.
+func (s *Server) HandleRequest(queryStruct *QueryStruct, connection *Connection) {
+	fmt.Printf("Command: %b Page: %d Phrase: %s\n", queryStruct.command, queryStruct.page, queryStruct.phrase)
 
-	request := buffer[:length]
-	queryStruct, err := s.ParseQuery(request)
+	ctx := connection.Context
+	if !queryStruct.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, queryStruct.deadline)
+		defer cancel()
+	}
+
+	if queryStruct.command == RELOAD {
+		s.HandleReload(queryStruct, connection)
+		return
+	}
+
+	str, err := s.BuildResponse(ctx, queryStruct)
 	if err != nil {
-		s.HandleResponse(fmt.Sprintf("Error: %s\n", err.Error()), connection)
+		s.HandleError(queryStruct, err, connection)
 		return
 	}
+	s.HandleResponse(queryStruct, str, connection)
+}
 
-	fmt.Printf("Command: %b Page: %d Phrase: %s\n", queryStruct.command, queryStruct.page, queryStruct.phrase)
+// BuildResponse runs the request on the Indexer and returns its JSON encoded response. The Mutex is
+// only held while the Indexer is used, so a slow client reading its response does not block a reload.
+func (s *Server) BuildResponse(ctx context.Context, queryStruct *QueryStruct) (string, error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	indexer := s.Indexer
 
+	var err error
 	query := strings.TrimSpace(queryStruct.phrase)
-	results := s.Indexer.Search(query, queryStruct.page)
-	str, err := SearchResultsToJSONString(results)
-	if err != nil {
-		s.HandleResponse(err.Error(), connection)
-		return
+	var str string
+	switch queryStruct.command {
+	case COMPLETE:
+		results := indexer.Complete(queryStruct.phrase, int(queryStruct.page))
+		str, err = CompletionResultsToJSONString(results)
+	case ADD, UPDATE, DELETE:
+		var result engine.DocumentResult
+		if queryStruct.command == DELETE {
+			result, err = indexer.DeleteDocument(query)
+		} else {
+			var doc engine.WikiXMLDoc
+			if doc, err = s.ReadDocument(queryStruct); err != nil {
+				return "", err
+			}
+			if queryStruct.command == ADD {
+				result, err = indexer.AddDocument(doc)
+			} else {
+				result, err = indexer.UpdateDocument(doc)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		str, err = DocumentResultToJSONString(result)
+	default:
+		var results engine.SearchResults
+		if results, err = indexer.SearchContext(ctx, query, queryStruct.page); err != nil {
+			return "", err
+		}
+		str, err = SearchResultsToJSONString(results)
 	}
-	s.HandleResponse(str, connection)
+	return str, err
 }
 
-func (s *Server) ParseQuery(query []byte) (*QueryStruct, error) {
-	if len(query) < 5 {
-		return nil, errors.New(fmt.Sprintf("invalid length: %d it should be at least 5 bytes", len(query)))
+// ParseQuery reads a request frame, the frame might arrive in several reads of the connection
+func (s *Server) ParseQuery(reader io.Reader) (*QueryStruct, error) {
+	header := make([]byte, RequestHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d, the server supports %d", header[0], ProtocolVersion)
 	}
-	command := query[0]
-	if command != QUERY {
+	command := header[1]
+	if command > RELOAD {
 		return nil, errors.New(fmt.Sprintf("invalid header byte %b for query command", command))
 	}
-	pageBytes := query[1:5]
-	page := BytesToUint32(pageBytes)
-
-	phrase := string(query[5:])
+	id := BytesToUint32(header[2:6])
+	page := BytesToUint32(header[6:10])
+	timeout := BytesToUint32(header[10:14])
+	length := BytesToUint32(header[14:18])
+	if length > MaxRequestSize {
+		return nil, fmt.Errorf("%w: %d bytes, the maximum is %d", ErrFrameTooLarge, length, MaxRequestSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
 
-	return &QueryStruct{
+	queryStruct := &QueryStruct{
+		id:      id,
 		command: command,
 		page:    page,
-		phrase:  phrase,
-	}, nil
+		phrase:  string(payload),
+	}
+	if timeout > 0 {
+		duration := time.Duration(timeout) * time.Millisecond
+		queryStruct.deadline = time.Now().Add(duration - duration/10)
+	}
+	return queryStruct, nil
 }
 
-func (s *Server) HandleResponse(response string, connection net.Conn) {
-	defer func(c net.Conn) {
-		if err := c.Close(); err != nil {
-			fmt.Printf("Error closing connection: %s\n", err.Error())
+// HandleReload starts a reload in the background, the response is sent once the reload has started
+func (s *Server) HandleReload(queryStruct *QueryStruct, connection *Connection) {
+	if addr, ok := connection.Conn.RemoteAddr().(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+		s.HandleError(queryStruct, errors.New("reload is only accepted from the loopback addresses"), connection)
+		return
+	}
+	if s.IsReloading() {
+		s.HandleError(queryStruct, errors.New("reload is already in progress"), connection)
+		return
+	}
+	go func(refresh bool) {
+		if err := s.Reload(refresh); err != nil {
+			fmt.Printf("Reloading the indexes failed: %s\n", err.Error())
 		}
-	}(connection)
+	}(queryStruct.page != 0)
+	s.HandleResponse(queryStruct, "Reloading the indexes", connection)
+}
 
-	if _, err := connection.Write([]byte(response + "\n")); err != nil {
+// ReadDocument decodes the JSON encoded document of the request
+func (s *Server) ReadDocument(queryStruct *QueryStruct) (engine.WikiXMLDoc, error) {
+	var doc engine.WikiXMLDoc
+	if err := json.Unmarshal([]byte(queryStruct.phrase), &doc); err != nil {
+		return doc, err
+	}
+	return doc, nil
+}
+
+// HandleResponse writes the response of the request
+func (s *Server) HandleResponse(queryStruct *QueryStruct, response string, connection *Connection) {
+	if err := connection.WriteResponse(queryStruct.id, StatusOK, []byte(response)); err != nil {
+		fmt.Printf("Error writing to the connection: %s\n", err.Error())
+	}
+}
+
+// HandleError writes the message of the error as the error response of the request
+func (s *Server) HandleError(queryStruct *QueryStruct, err error, connection *Connection) {
+	if err := connection.WriteResponse(queryStruct.id, StatusError, []byte(err.Error())); err != nil {
 		fmt.Printf("Error writing to the connection: %s\n", err.Error())
 	}
 }
 
+// AcceptConnections serves the connections until the server is shut down, ErrServerClosed is returned
+// after Shutdown
 func (s *Server) AcceptConnections() error {
 	listener, err := net.Listen(s.Network, s.Address())
 	if err != nil {
 		return err
 	}
 	defer func(l net.Listener) {
-		if err := l.Close(); err != nil {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			fmt.Printf("Error closing listener: %s\n", err.Error())
 		}
 	}(listener)
 
+	s.ConnectionMutex.Lock()
+	if s.Quitting() {
+		s.ConnectionMutex.Unlock()
+		return ErrServerClosed
+	}
+	s.Listener = listener
+	s.ConnectionMutex.Unlock()
+
 	fmt.Printf("Accepting connections on %s\n", s.Signature())
 
-	for !s.QuitSignal {
-		if con, err := listener.Accept(); err != nil {
+	for {
+		con, err := listener.Accept()
+		if err != nil {
+			if s.Quitting() {
+				break
+			}
 			fmt.Printf("Error accepting connection: %s\n", err.Error())
-		} else {
-			go s.HandleRequest(con)
+			continue
 		}
+		go s.HandleConnection(con)
 	}
 	fmt.Printf("Server closed on %s\n", s.Signature())
-	return nil
+	return ErrServerClosed
 }
@@ -0,0 +1,362 @@
+package tcpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/xkmsoft/wikisearcher/pkg/engine"
+	"github.com/xkmsoft/wikisearcher/pkg/tcpclient"
+)
+
+func TestParseQueryPartialReads(t *testing.T) {
+	client := tcpclient.NewTCPClient("localhost", "0", "tcp")
+	phrase := strings.Repeat("alpha OR beta ", 200)
+	s := NewServer("localhost", "0", "tcp", []int{1}, false)
+
+	queryStruct, err := s.ParseQuery(iotest.OneByteReader(bytes.NewReader(client.PrepareRequest(COMPLETE, phrase, 7))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queryStruct.command != COMPLETE || queryStruct.page != 7 || queryStruct.phrase != phrase {
+		t.Fatalf("unexpected request %d %d %q", queryStruct.command, queryStruct.page, queryStruct.phrase)
+	}
+}
+
+func TestParseQueryDeadline(t *testing.T) {
+	client := tcpclient.NewTCPClient("localhost", "0", "tcp")
+	s := NewServer("localhost", "0", "tcp", []int{1}, false)
+
+	request := client.PrepareQuery("alpha", 1)
+	queryStruct, err := s.ParseQuery(bytes.NewReader(request))
+	if err != nil || !queryStruct.deadline.IsZero() {
+		t.Fatalf("expected no deadline, got %v %v", queryStruct, err)
+	}
+	copy(request[10:14], tcpclient.Uint32ToBytes(1000))
+	if queryStruct, err = s.ParseQuery(bytes.NewReader(request)); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := time.Until(queryStruct.deadline); remaining <= 0 || remaining > 900*time.Millisecond {
+		t.Fatalf("unexpected deadline in %v", remaining)
+	}
+}
+
+func TestParseQueryInvalidFrames(t *testing.T) {
+	client := tcpclient.NewTCPClient("localhost", "0", "tcp")
+	s := NewServer("localhost", "0", "tcp", []int{1}, false)
+
+	oversized := client.PrepareRequest(QUERY, "", 1)
+	copy(oversized[14:18], tcpclient.Uint32ToBytes(MaxRequestSize+1))
+	if _, err := s.ParseQuery(bytes.NewReader(oversized)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+
+	request := client.PrepareQuery("alpha", 1)
+	if _, err := s.ParseQuery(bytes.NewReader(request[:len(request)-1])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	request[0] = ProtocolVersion + 1
+	if _, err := s.ParseQuery(bytes.NewReader(request)); err == nil {
+		t.Fatal("expected an error for an unsupported version")
+	}
+}
+
+func TestResponseFrames(t *testing.T) {
+	var buffer bytes.Buffer
+	payload := strings.Repeat("x", 5000)
+	if err := WriteFrame(&buffer, 7, StatusOK, []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(&buffer, 8, StatusError, []byte("document not found")); err != nil {
+		t.Fatal(err)
+	}
+	reader := iotest.OneByteReader(&buffer)
+	frame, err := tcpclient.ReadResponse(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, err := frame.Result(); err != nil || frame.Id != 7 || string(response) != payload {
+		t.Fatalf("unexpected response %d of %d bytes: %v", frame.Id, len(response), err)
+	}
+	if frame, err = tcpclient.ReadResponse(reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := frame.Result(); frame.Id != 8 || err == nil || err.Error() != "document not found" {
+		t.Fatalf("expected the error response, got %d %v", frame.Id, err)
+	}
+
+	oversized := make([]byte, ResponseHeaderSize)
+	copy(oversized[5:], tcpclient.Uint32ToBytes(tcpclient.MaxResponseSize+1))
+	if _, err := tcpclient.ReadResponse(bytes.NewReader(oversized)); !errors.Is(err, tcpclient.ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+// NewTestServer serves a few documents on a random port of the loopback address
+func NewTestServer(t *testing.T) (*Server, *tcpclient.TCPClient) {
+	s := NewServer("localhost", "0", "tcp", []int{1}, false)
+	for _, doc := range []engine.WikiXMLDoc{
+		{Title: "Wikipedia: Alpha", Url: "https://en.wikipedia.org/wiki/Alpha", Abstract: "alpha is the first letter"},
+		{Title: "Wikipedia: Beta", Url: "https://en.wikipedia.org/wiki/Beta", Abstract: "beta follows alpha"},
+		{Title: "Wikipedia: Gamma", Url: "https://en.wikipedia.org/wiki/Gamma", Abstract: "gamma follows beta and alpha"},
+	} {
+		if _, err := s.Indexer.AddDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.HandleConnection(conn)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	client := tcpclient.NewTCPClient("127.0.0.1", port, "tcp")
+	t.Cleanup(func() { _ = client.Close() })
+	return s, client
+}
+
+func TestHandleFragmentedRequest(t *testing.T) {
+	_, client := NewTestServer(t)
+	conn, err := net.Dial("tcp", client.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := client.PrepareQuery("gamma", 1)
+	for _, fragment := range [][]byte{request[:3], request[3:12], request[12:]} {
+		if _, err := conn.Write(fragment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frame, err := tcpclient.ReadResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := frame.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results engine.SearchResults
+	if err := json.Unmarshal(response, &results); err != nil {
+		t.Fatal(err)
+	}
+	if results.NumberOfResults != 1 {
+		t.Fatalf("expected 1 result, got %d", results.NumberOfResults)
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	_, client := NewTestServer(t)
+	expected := map[string]int{"alpha": 3, "beta": 2, "gamma": 1, "delta": 0}
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		for query, count := range expected {
+			wg.Add(1)
+			go func(query string, count int) {
+				defer wg.Done()
+				results, err := client.Query(query, 1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if results.NumberOfResults != count {
+					t.Errorf("%s: expected %d results, got %d", query, count, results.NumberOfResults)
+				}
+			}(query, count)
+		}
+	}
+	if _, err := client.DeleteDocument("https://en.wikipedia.org/wiki/Omega"); err == nil {
+		t.Error("expected an error response for a missing document")
+	}
+	wg.Wait()
+
+	// The connection is closed by the server after an invalid frame, and the client dials again
+	if _, err := client.Send([]byte{0, QUERY, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Fatal("expected an error for an unsupported version")
+	}
+	if results, err := client.Query("alpha", 1); err != nil || results.NumberOfResults != 3 {
+		t.Fatalf("unexpected results after reconnecting: %v", err)
+	}
+}
+
+func TestRequestContexts(t *testing.T) {
+	s, client := NewTestServer(t)
+
+	// The requests waiting past their deadlines are not handled, and the connection is kept
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.Mutex.Lock()
+	time.AfterFunc(50*time.Millisecond, s.Mutex.Unlock)
+	if _, err := client.QueryContext(ctx, "alpha", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	request := client.PrepareQuery("alpha", 1)
+	copy(request[10:14], tcpclient.Uint32ToBytes(1))
+	s.Mutex.Lock()
+	time.AfterFunc(50*time.Millisecond, s.Mutex.Unlock)
+	conn, err := net.Dial("tcp", client.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := tcpclient.ReadResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := frame.Result(); err == nil || !strings.Contains(err.Error(), "deadline") {
+		t.Fatalf("expected the deadline error response, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.QueryContext(ctx, "alpha", 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if results, err := client.QueryContext(ctx, "alpha", 1); err != nil || results.NumberOfResults != 3 || results.TimedOut {
+		t.Fatalf("unexpected results within the deadline: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, client := NewTestServer(t)
+	if _, err := client.Query("alpha", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request waiting for the indexer is completed before the server shuts down
+	s.Mutex.Lock()
+	queried := make(chan error, 1)
+	go func() {
+		results, err := client.Query("beta", 1)
+		if err == nil && results.NumberOfResults != 2 {
+			err = fmt.Errorf("expected 2 results, got %d", results.NumberOfResults)
+		}
+		queried <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown returned before the request was completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Mutex.Unlock()
+	if err := <-queried; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Query("alpha", 1); err == nil {
+		t.Fatal("expected the connections to be refused after the shutdown")
+	}
+	if err := s.Shutdown(context.Background()); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+
+	// The deadline bounds the wait for the indexer held by a stuck request
+	s, _ = NewTestServer(t)
+	s.Mutex.RLock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(t0); elapsed > time.Second {
+		t.Fatalf("shutdown exceeded its deadline by %v", elapsed)
+	}
+	s.Mutex.RUnlock()
+
+	// AcceptConnections returns once the listener is closed
+	s = NewServer("127.0.0.1", "0", "tcp", []int{1}, false)
+	accepted := make(chan error, 1)
+	go func() { accepted <- s.AcceptConnections() }()
+	for listening := false; !listening; time.Sleep(time.Millisecond) {
+		s.ConnectionMutex.Lock()
+		listening = s.Listener != nil
+		s.ConnectionMutex.Unlock()
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-accepted; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestReplaceAbstractFiles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	s := NewServer("localhost", "0", "tcp", []int{1}, false)
+	staging := filepath.Join(DataDirectory, ReloadDirectory)
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		t.Fatal(err)
+	}
+	current, staged := s.GetAbstractStructs()[0], s.StagedAbstractStructs(staging)
+	for _, path := range current.Files() {
+		if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range staged[0].Files() {
+		if path != staged[0].JSONDump {
+			if err := os.WriteFile(path, []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.ReplaceAbstractFiles(staged); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range current.Files() {
+		b, err := os.ReadFile(path)
+		if path == current.JSONDump {
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected the stale %s to be removed: %v", path, err)
+			}
+			continue
+		}
+		if err != nil || string(b) != "new" {
+			t.Fatalf("expected the staged %s, got %q %v", path, b, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package tcpserver
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Quitting reports whether the server is shutting down
+func (s *Server) Quitting() bool {
+	select {
+	case <-s.QuitSignal:
+		return true
+	default:
+		return false
+	}
+}
+
+// AddConnection tracks the connection until it is removed, the connections are refused once the
+// server is shutting down
+func (s *Server) AddConnection(connection *Connection) bool {
+	s.ConnectionMutex.Lock()
+	defer s.ConnectionMutex.Unlock()
+	if s.Quitting() {
+		return false
+	}
+	s.Connections[connection] = true
+	s.ConnectionGroup.Add(1)
+	return true
+}
+
+func (s *Server) RemoveConnection(connection *Connection) {
+	s.ConnectionMutex.Lock()
+	defer s.ConnectionMutex.Unlock()
+	delete(s.Connections, connection)
+	s.ConnectionGroup.Done()
+}
+
+// ExtendReadDeadline waits for the next request up to the IdleTimeout. The deadline is set under the
+// ConnectionMutex, so it does not override the deadline Shutdown sets to stop reading the requests.
+func (s *Server) ExtendReadDeadline(connection *Connection) error {
+	s.ConnectionMutex.Lock()
+	defer s.ConnectionMutex.Unlock()
+	if s.Quitting() {
+		return ErrServerClosed
+	}
+	return connection.Conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+}
+
+// Shutdown stops accepting the connections and reading the requests, and waits for the requests being
+// handled until the context is done. The requests still running then are canceled, so the queries
+// respond with their partial results, and the responses are written up to the WriteTimeout. The
+// segment store is flushed once the requests are completed. The error of the context is returned if
+// the requests or the flush did not complete in time, the flush then continues in the background.
+func (s *Server) Shutdown(ctx context.Context) error {
+	t0 := time.Now()
+	defer func(t0 time.Time) {
+		fmt.Printf("Shutting down the server took %f seconds\n", time.Since(t0).Seconds())
+	}(t0)
+
+	s.ConnectionMutex.Lock()
+	if s.Quitting() {
+		s.ConnectionMutex.Unlock()
+		return ErrServerClosed
+	}
+	fmt.Printf("Shutting down the server on %s\n", s.Signature())
+	close(s.QuitSignal)
+	if s.Listener != nil {
+		if err := s.Listener.Close(); err != nil {
+			fmt.Printf("Error closing listener: %s\n", err.Error())
+		}
+	}
+	writeDeadline := time.Now().Add(WriteTimeout)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(writeDeadline) {
+		writeDeadline = deadline
+	}
+	for connection := range s.Connections {
+		if err := connection.Conn.SetReadDeadline(time.Now()); err != nil {
+			fmt.Printf("Error setting the deadline of the connection: %s\n", err.Error())
+		}
+		if err := connection.Conn.SetWriteDeadline(writeDeadline); err != nil {
+			fmt.Printf("Error setting the deadline of the connection: %s\n", err.Error())
+		}
+	}
+	s.ConnectionMutex.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		s.ConnectionGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.ConnectionMutex.Lock()
+		fmt.Printf("Canceling the requests of %d connections: %s\n", len(s.Connections), ctx.Err().Error())
+		for connection := range s.Connections {
+			connection.Cancel()
+			// Aborts the responses blocked on the stalled clients
+			_ = connection.Conn.SetWriteDeadline(time.Now())
+		}
+		s.ConnectionMutex.Unlock()
+	}
+
+	// Acquiring the lock waits for the requests using the indexer, so the store flushes all the
+	// modifications
+	flushed := make(chan error, 1)
+	go func() {
+		s.Mutex.Lock()
+		defer s.Mutex.Unlock()
+		var err error
+		if s.Store != nil {
+			if err = s.Store.Close(); err != nil {
+				fmt.Printf("Flushing the segment store failed: %s\n", err.Error())
+			}
+			s.Store = nil
+		}
+		flushed <- err
+	}()
+	select {
+	case err := <-flushed:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	case <-ctx.Done():
+		fmt.Printf("Flushing the segment store did not complete: %s\n", ctx.Err().Error())
+		return ctx.Err()
+	}
+}
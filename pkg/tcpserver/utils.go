@@ -3,6 +3,11 @@ package tcpserver
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/xkmsoft/wikisearcher/pkg/engine"
 )
@@ -15,6 +20,66 @@ func SearchResultsToJSONString(results engine.SearchResults) (string, error) {
 	}
 }
 
+func CompletionResultsToJSONString(results engine.CompletionResults) (string, error) {
+	if bytes, err := json.Marshal(results); err != nil {
+		return "", err
+	} else {
+		return string(bytes), nil
+	}
+}
+
+func DocumentResultToJSONString(result engine.DocumentResult) (string, error) {
+	if bytes, err := json.Marshal(result); err != nil {
+		return "", err
+	} else {
+		return string(bytes), nil
+	}
+}
+
 func BytesToUint32(bytes []byte) uint32 {
 	return binary.BigEndian.Uint32(bytes)
 }
+
+// WriteFrame writes the response frame of the request with the status
+func WriteFrame(w io.Writer, id uint32, status byte, payload []byte) error {
+	frame := make([]byte, ResponseHeaderSize, ResponseHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], id)
+	frame[4] = status
+	binary.BigEndian.PutUint32(frame[5:ResponseHeaderSize], uint32(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ParseFileIndexes parses a comma separated list of abstract file indexes and ranges, e.g. 1,3,5-7,
+// and returns the unique indexes in ascending order
+func ParseFileIndexes(s string) ([]int, error) {
+	unique := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		first, last := part, part
+		if idx := strings.Index(part, "-"); idx > 0 {
+			first, last = part[:idx], part[idx+1:]
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid abstract index %q", part)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("invalid abstract index %q", part)
+		}
+		if from < 0 || to >= AbstractFilesCount || from > to {
+			return nil, fmt.Errorf("invalid abstract index range %q, indexes should be [0, %d]", part, AbstractFilesCount-1)
+		}
+		for index := from; index <= to; index++ {
+			unique[index] = true
+		}
+	}
+	indexes := make([]int, 0, len(unique))
+	for index := range unique {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}